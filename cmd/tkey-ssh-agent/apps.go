@@ -7,6 +7,10 @@ import (
 	"crypto/sha512"
 	_ "embed"
 	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/tillitis/tkeyclient"
 )
@@ -18,7 +22,8 @@ func (err constError) Error() string {
 }
 
 const (
-	ErrNotFound = constError("not found")
+	ErrNotFound    = constError("not found")
+	ErrWrongDigest = constError("app digest mismatch")
 )
 
 // nolint:typecheck // Avoid lint error when the embedding file is missing.
@@ -31,45 +36,167 @@ var appBinaryPreCastor []byte
 //go:embed device-app/signer.bin-castor-alpha-1
 var appBinaryCastor []byte
 
+// The digests of the embedded binaries, as listed in the source tree,
+// in sha512sum(1) format.
+//
+//go:embed device-app/signers.sha512
+var appDigests string
+
+// EmbeddedApp is a signer app binary built into the agent.
 type EmbeddedApp struct {
-	name   string
-	digest string
+	name    string
+	version string
+	file    string // under device-app
+	digest  string
+	bin     []byte
 }
 
 // List data about the embedded binaries.
 func ListApps() []EmbeddedApp {
 	list := []EmbeddedApp{
 		{
-			name:   "tkey-device-signer 1.0.2",
-			digest: AppDigest(appBinaryPreCastor),
+			name:    "tkey-device-signer 1.0.2",
+			version: "1.0.2",
+			file:    "signer.bin-v1.0.2",
+			digest:  AppDigest(appBinaryPreCastor),
+			bin:     appBinaryPreCastor,
 		},
 		{
-			name:   "tkey-device-signer castor-alpha-1",
-			digest: AppDigest(appBinaryCastor),
+			name:    "tkey-device-signer castor-alpha-1",
+			version: "castor-alpha-1",
+			file:    "signer.bin-castor-alpha-1",
+			digest:  AppDigest(appBinaryCastor),
+			bin:     appBinaryCastor,
 		},
 	}
 
 	return list
 }
 
+// CheckApps checks that each embedded app has the digest listed for
+// it in signers.sha512, so that a patched or rebuilt binary is never
+// loaded onto a TKey by mistake.
+func CheckApps() error {
+	listed := parseDigests(appDigests)
+
+	for _, app := range ListApps() {
+		digest, ok := listed[app.file]
+		if !ok {
+			return fmt.Errorf("%s: not listed in signers.sha512", app.file)
+		}
+		if digest != app.digest {
+			return fmt.Errorf("%s: %w, SHA512 is %s but signers.sha512 says %s", app.file, ErrWrongDigest, app.digest, digest)
+		}
+	}
+
+	return nil
+}
+
+// parseDigests returns the digests in a list in sha512sum(1) format,
+// by file name.
+func parseDigests(list string) map[string]string {
+	digests := map[string]string{}
+
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// sha512sum marks files read in binary mode with '*'
+		digests[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+
+	return digests
+}
+
+// productNames are the names of the TKey models, by UDI product ID.
+var productNames = map[uint8]string{
+	tkeyclient.UDIPIDEngSample: "Engineering sample",
+	tkeyclient.UDIPIDAcrab:     "Acrab",
+	tkeyclient.UDIPIDBellatrix: "Bellatrix",
+	tkeyclient.UDIPIDCastor:    "Castor",
+}
+
+// defaultProducts returns the product IDs that app is loaded onto by
+// default, sorted.
+func (app EmbeddedApp) defaultProducts() []uint8 {
+	var pids []uint8
+	for pid, version := range defaultApps {
+		if version == app.version {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	return pids
+}
+
+// defaultApps maps UDI product IDs to the version of the embedded
+// signer app to use on them, unless configured otherwise.
+var defaultApps = map[uint8]string{
+	tkeyclient.UDIPIDEngSample: "castor-alpha-1",
+	tkeyclient.UDIPIDAcrab:     "1.0.2",
+	tkeyclient.UDIPIDBellatrix: "1.0.2",
+	tkeyclient.UDIPIDCastor:    "castor-alpha-1",
+}
+
+// GetEmbeddedApp returns the embedded app with version, or
+// ErrNotFound.
+func GetEmbeddedApp(version string) (EmbeddedApp, error) {
+	for _, app := range ListApps() {
+		if app.version == version {
+			return app, nil
+		}
+	}
+
+	return EmbeddedApp{}, ErrNotFound
+}
+
 // GetApp looks up what type of app is needed depending on the UDI
 // product ID pid. It returns the app binary and any error.
 func GetApp(pid uint8) ([]byte, error) {
-	switch pid {
-	case tkeyclient.UDIPIDEngSample:
-		return appBinaryCastor, nil
-	case tkeyclient.UDIPIDAcrab:
-		return appBinaryPreCastor, nil
-	case tkeyclient.UDIPIDBellatrix:
-		return appBinaryPreCastor, nil
-	case tkeyclient.UDIPIDCastor:
-		return appBinaryCastor, nil
+	version, ok := defaultApps[pid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	app, err := GetEmbeddedApp(version)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, ErrNotFound
+	return app.bin, nil
 }
 
 func AppDigest(bin []byte) string {
 	digest := sha512.Sum512(bin)
 	return hex.EncodeToString(digest[:])
 }
+
+// AppFile is a signer app binary on disk, and the SHA-512 digest it
+// must have for us to load it.
+type AppFile struct {
+	Path   string `json:"file"`
+	Digest string `json:"digest"`
+}
+
+// Read returns the app binary, or ErrWrongDigest if it isn't the app
+// we expect.
+func (f AppFile) Read() ([]byte, error) {
+	bin, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	if digest := AppDigest(bin); !strings.EqualFold(digest, f.Digest) {
+		return nil, fmt.Errorf("%s: %w, SHA512 is %s", f.Path, ErrWrongDigest, digest)
+	}
+
+	return bin, nil
+}
+
+// validDigest tells if digest looks like a hex encoded SHA-512 digest.
+func validDigest(digest string) bool {
+	b, err := hex.DecodeString(digest)
+	return err == nil && len(b) == sha512.Size
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const appsUsage = `Usage: %[1]s apps [list]
+       %[1]s apps extract VERSION FILE
+       %[1]s apps verify FILE [DIGESTS]
+
+list     List the embedded signer apps, what TKey models they are
+         loaded onto by default, their sizes and SHA512 digests.
+extract  Write the embedded app with VERSION, as shown by list, to
+         FILE. Use '-' (dash) to write to stdout.
+verify   Check that the SHA512 digest of the app binary in FILE is in
+         DIGESTS, a list in sha512sum(1) format. The default is the
+         list the embedded apps were built with.
+`
+
+// appsCommand runs the apps subcommand with args, and returns the
+// exit code.
+func appsCommand(args []string) int {
+	cmd := "list"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch {
+	case cmd == "list" && len(args) == 0:
+		return listAppsCommand()
+	case cmd == "extract" && len(args) == 2:
+		return extractAppCommand(args[0], args[1])
+	case cmd == "verify" && (len(args) == 1 || len(args) == 2):
+		return verifyAppCommand(args)
+	}
+
+	le.Printf(appsUsage, progname)
+	return 2
+}
+
+func listAppsCommand() int {
+	listed := parseDigests(appDigests)
+	code := 0
+
+	for _, app := range ListApps() {
+		var products []string
+		for _, pid := range app.defaultProducts() {
+			products = append(products, fmt.Sprintf("%s (%d)", productNames[pid], pid))
+		}
+		if len(products) == 0 {
+			products = append(products, "none")
+		}
+
+		check := "ok"
+		if digest, ok := listed[app.file]; !ok {
+			check = "FAILED, not in signers.sha512"
+			code = 1
+		} else if digest != app.digest {
+			check = "FAILED, doesn't match signers.sha512"
+			code = 1
+		}
+
+		fmt.Printf("%s\n", app.name)
+		fmt.Printf("  Version:  %s\n", app.version)
+		fmt.Printf("  Products: %s\n", strings.Join(products, ", "))
+		fmt.Printf("  Size:     %d bytes\n", len(app.bin))
+		fmt.Printf("  SHA512:   %s\n", app.digest)
+		fmt.Printf("  Check:    %s\n", check)
+	}
+
+	return code
+}
+
+func extractAppCommand(version string, path string) int {
+	app, err := GetEmbeddedApp(version)
+	if err != nil {
+		le.Printf("No embedded app with version %s, see '%s apps list'.\n", version, progname)
+		return 1
+	}
+
+	if path == "-" {
+		if _, err := os.Stdout.Write(app.bin); err != nil {
+			le.Printf("%s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Don't overwrite anything by mistake
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		le.Printf("%s\n", err)
+		return 1
+	}
+	if _, err := f.Write(app.bin); err != nil {
+		f.Close()
+		le.Printf("%s\n", err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		le.Printf("%s\n", err)
+		return 1
+	}
+
+	le.Printf("Wrote %s to %s\nSHA512: %s\n", app.name, path, app.digest)
+
+	return 0
+}
+
+func verifyAppCommand(args []string) int {
+	bin, err := os.ReadFile(args[0])
+	if err != nil {
+		le.Printf("%s\n", err)
+		return 1
+	}
+
+	list, listName := appDigests, "the embedded signers.sha512"
+	if len(args) == 2 {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			le.Printf("%s\n", err)
+			return 1
+		}
+		list, listName = string(data), args[1]
+	}
+
+	digest := AppDigest(bin)
+	fmt.Printf("SHA512: %s\n", digest)
+
+	for file, listed := range parseDigests(list) {
+		if listed == digest {
+			fmt.Printf("OK, matches %s in %s\n", file, listName)
+			return 0
+		}
+	}
+
+	fmt.Printf("FAILED, not in %s\n", listName)
+
+	return 1
+}
@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The broker protocol lets other local programs use the TKeys through
+// the agent. Each request and response is a frame: a 4 byte big-endian
+// length followed by that many bytes. A request starts with an
+// operation byte, a response with a status byte.
+//
+//	get public keys: brokerGetPubkeys
+//	  -> brokerOK, then for each key: 32 byte Ed25519 public key,
+//	     2 byte big-endian comment length, comment
+//	sign:            brokerSign, 32 byte public key, message
+//	  -> brokerOK, 64 byte Ed25519 signature of brokerSignedData(message)
+//
+// On failure the response is brokerError followed by a message.
+const (
+	brokerGetPubkeys = 0x01
+	brokerSign       = 0x02
+
+	brokerOK    = 0x00
+	brokerError = 0x01
+
+	// Way more than the signer app can sign in one go
+	brokerMaxFrame = 16 * 1024
+
+	// The SSHSIG namespace of broker signatures
+	brokerNamespace = "tkey-ssh-agent-broker"
+)
+
+// Broker serves the broker protocol, using the TKeys of agent.
+type Broker struct {
+	agent *SSHAgent
+}
+
+func NewBroker(agent *SSHAgent) *Broker {
+	return &Broker{agent: agent}
+}
+
+func (b *Broker) Serve(path string) error {
+	listener, err := nativeListen(path)
+	if err != nil {
+		notify(fmt.Sprintf("Could not create broker listener: %s", err))
+		return fmt.Errorf("%w", err)
+	}
+	le.Printf("Broker listening on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		le.Printf("Handling a broker client connection\n")
+		go b.handleConn(conn)
+	}
+}
+
+func (b *Broker) handleConn(c net.Conn) {
+	defer c.Close()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	rw := watchConn(c, cancel)
+
+	for {
+		req, err := readFrame(rw)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				le.Printf("Broker client connection ended with error: %s\n", err)
+			}
+			return
+		}
+
+		if err := writeFrame(rw, b.handle(ctx, req)); err != nil {
+			le.Printf("Broker: %s\n", err)
+			return
+		}
+	}
+}
+
+func (b *Broker) handle(ctx context.Context, req []byte) []byte {
+	if len(req) == 0 {
+		return brokerFailure(errors.New("empty request"))
+	}
+
+	switch req[0] {
+	case brokerGetPubkeys:
+		keys, err := b.agent.List()
+		if err != nil {
+			return brokerFailure(err)
+		}
+
+		resp := []byte{brokerOK}
+		for _, key := range keys {
+			pub, err := ssh.ParsePublicKey(key.Blob)
+			if err != nil {
+				return brokerFailure(err)
+			}
+			edPub, ok := pub.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+			if !ok {
+				continue
+			}
+			resp = append(resp, edPub...)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(key.Comment)))
+			resp = append(resp, key.Comment...)
+		}
+
+		return resp
+
+	case brokerSign:
+		if len(req) < 1+ed25519.PublicKeySize {
+			return brokerFailure(errors.New("short sign request"))
+		}
+
+		key, err := ssh.NewPublicKey(ed25519.PublicKey(req[1 : 1+ed25519.PublicKeySize]))
+		if err != nil {
+			return brokerFailure(err)
+		}
+
+		data := brokerSignedData(req[1+ed25519.PublicKeySize:])
+		sig, err := b.agent.signFor(ctx, key, data, "signing for another program")
+		if err != nil {
+			return brokerFailure(err)
+		}
+
+		return append([]byte{brokerOK}, sig.Blob...)
+	}
+
+	return brokerFailure(fmt.Errorf("unknown operation %d", req[0]))
+}
+
+// brokerSignedData returns what the broker signs for message: the
+// SSHSIG signed data for it in brokerNamespace. It can't be mistaken
+// for an SSH login, a Git commit or anything else signed with the key.
+func brokerSignedData(message []byte) []byte {
+	hash := sha512.Sum512(message)
+
+	return append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{
+		Namespace: brokerNamespace,
+		HashAlg:   "sha512",
+		Hash:      hash[:],
+	})...)
+}
+
+func brokerFailure(err error) []byte {
+	le.Printf("Broker: %s\n", err)
+	return append([]byte{brokerError}, err.Error()...)
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > brokerMaxFrame {
+		return nil, fmt.Errorf("frame of %d bytes is too long", n)
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	if _, err := w.Write(append(buf, frame...)); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config is what's read from the configuration file. All of it is
+// optional.
+type Config struct {
+	Devices []DeviceConfig `json:"devices"`
+	Apps    []AppConfig    `json:"apps"`
+	// SHA512 digests of signer app builds, besides the embedded
+	// ones, known to require a touch to sign
+	TouchApps []string `json:"touch_apps"`
+}
+
+// DeviceConfig holds settings for a specific TKey, recognised by its
+// USB serial number or by its UDI.
+type DeviceConfig struct {
+	Name   string `json:"name"`
+	Serial string `json:"serial,omitempty"`
+	UDI    string `json:"udi,omitempty"`
+	// Where to get the USS from, one of the uss* constants. Empty
+	// means to use what was passed on the command line.
+	USS     string `json:"uss,omitempty"`
+	USSFile string `json:"uss_file,omitempty"`
+	// The public key the TKey is expected to have, as in
+	// authorized_keys. Any other key is refused.
+	Pubkey string `json:"pubkey,omitempty"`
+
+	pinned ssh.PublicKey
+}
+
+// AppConfig selects the signer app to load onto TKeys with a certain
+// UDI product ID: another embedded version, or a binary on disk.
+type AppConfig struct {
+	ProductID *uint8 `json:"product_id"`
+	// Version of an embedded app, as shown by --version
+	Embedded string `json:"embedded,omitempty"`
+	AppFile
+}
+
+const (
+	ussPrompt = "prompt"
+	ussFile   = "file"
+	ussNone   = "none"
+)
+
+// defaultConfigPath returns where we look for the configuration file
+// if none is passed, or "" if there is no such place.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, progname, "config.json")
+}
+
+// LoadConfig reads the configuration file at path. A missing file is
+// only an error if mustExist is set.
+func LoadConfig(path string, mustExist bool) (*Config, error) {
+	var conf Config
+
+	if path == "" {
+		return &conf, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !mustExist && errors.Is(err, os.ErrNotExist) {
+			return &conf, nil
+		}
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	for i, dev := range conf.Devices {
+		if dev.Serial == "" && dev.UDI == "" {
+			return nil, fmt.Errorf("config file %s: device %d has neither serial nor udi", path, i)
+		}
+
+		if dev.Pubkey != "" {
+			pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(dev.Pubkey))
+			if err != nil || pinned.Type() != ssh.KeyAlgoED25519 {
+				return nil, fmt.Errorf("config file %s: device %d needs pubkey as an ssh-ed25519 key", path, i)
+			}
+			conf.Devices[i].pinned = pinned
+		}
+
+		switch dev.USS {
+		case "", ussPrompt, ussNone:
+			if dev.USSFile != "" {
+				return nil, fmt.Errorf("config file %s: device %d has uss_file but uss is not \"%s\"", path, i, ussFile)
+			}
+		case ussFile:
+			if dev.USSFile == "" {
+				return nil, fmt.Errorf("config file %s: device %d needs uss_file", path, i)
+			}
+		default:
+			return nil, fmt.Errorf("config file %s: device %d has unknown uss \"%s\"", path, i, dev.USS)
+		}
+	}
+
+	seen := map[uint8]bool{}
+	for i, app := range conf.Apps {
+		switch {
+		case app.ProductID == nil:
+			return nil, fmt.Errorf("config file %s: app %d has no product_id", path, i)
+		case seen[*app.ProductID]:
+			return nil, fmt.Errorf("config file %s: app %d has the same product_id as another", path, i)
+		case app.Embedded != "":
+			if app.Path != "" || app.Digest != "" {
+				return nil, fmt.Errorf("config file %s: app %d has both embedded and file", path, i)
+			}
+			if _, err := GetEmbeddedApp(app.Embedded); err != nil {
+				return nil, fmt.Errorf("config file %s: app %d has unknown embedded app \"%s\"", path, i, app.Embedded)
+			}
+		case app.Path == "":
+			return nil, fmt.Errorf("config file %s: app %d needs embedded or file", path, i)
+		case !validDigest(app.Digest):
+			return nil, fmt.Errorf("config file %s: app %d needs digest, the SHA512 of the file in hex", path, i)
+		}
+		seen[*app.ProductID] = true
+	}
+
+	for i, digest := range conf.TouchApps {
+		if !validDigest(digest) {
+			return nil, fmt.Errorf("config file %s: touch_apps entry %d is not a SHA512 digest in hex", path, i)
+		}
+	}
+
+	return &conf, nil
+}
+
+// App returns the signer app to use for TKeys with product ID pid,
+// or nil to use the default one.
+func (c *Config) App(pid uint8) *AppConfig {
+	for i := range c.Apps {
+		if *c.Apps[i].ProductID == pid {
+			return &c.Apps[i]
+		}
+	}
+
+	return nil
+}
+
+// app returns the app binary. One from a file is only returned if it
+// has the expected digest.
+func (ac *AppConfig) app() ([]byte, error) {
+	if ac.Embedded != "" {
+		app, err := GetEmbeddedApp(ac.Embedded)
+		return app.bin, err
+	}
+
+	return ac.Read()
+}
+
+// digest returns the digest of the app.
+func (ac *AppConfig) digest() (string, error) {
+	if ac.Embedded != "" {
+		app, err := GetEmbeddedApp(ac.Embedded)
+		return app.digest, err
+	}
+
+	return strings.ToLower(ac.Digest), nil
+}
+
+// Device returns the settings for the TKey with USB serial number
+// serial and UDI udi, or nil if there are none. Either may be empty if
+// not known.
+func (c *Config) Device(serial string, udi string) *DeviceConfig {
+	for i := range c.Devices {
+		if c.Devices[i].matches(serial, udi) {
+			return &c.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// matches tells if all identifiers of dc that we know the value of
+// match, and that there was at least one of them.
+func (dc *DeviceConfig) matches(serial string, udi string) bool {
+	known := false
+
+	if dc.UDI != "" && udi != "" {
+		if !strings.EqualFold(dc.UDI, udi) {
+			return false
+		}
+		known = true
+	}
+
+	if dc.Serial != "" && serial != "" {
+		if dc.Serial != serial {
+			return false
+		}
+		known = true
+	}
+
+	return known
+}
+
+// pinnedByUDI returns the devices with a pinned key that are
+// recognised by UDI, and might be the TKey with USB serial number
+// serial.
+func (c *Config) pinnedByUDI(serial string) []*DeviceConfig {
+	var devs []*DeviceConfig
+	for i := range c.Devices {
+		dc := &c.Devices[i]
+		if dc.pinned != nil && dc.UDI != "" && (dc.Serial == "" || dc.Serial == serial) {
+			devs = append(devs, dc)
+		}
+	}
+
+	return devs
+}
+
+// keyMatches tells if pub is the key the device is expected to have,
+// which is any key if none is pinned.
+func (dc *DeviceConfig) keyMatches(pub ed25519.PublicKey) bool {
+	if dc == nil || dc.pinned == nil {
+		return true
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(sshPub.Marshal(), dc.pinned.Marshal())
+}
+
+// ussConfig returns the USS configuration to use for the device,
+// based on def from the command line.
+func (dc *DeviceConfig) ussConfig(def UssConfig) UssConfig {
+	uss := def
+
+	switch dc.USS {
+	case ussPrompt:
+		uss.EnterManually = true
+		uss.Path = ""
+	case ussFile:
+		uss.EnterManually = false
+		uss.Path = dc.USSFile
+	case ussNone:
+		uss.EnterManually = false
+		uss.Path = ""
+	}
+
+	return uss
+}
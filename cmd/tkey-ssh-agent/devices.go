@@ -0,0 +1,589 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/ssh"
+)
+
+// How often to look for a TKey while waiting for it to be inserted.
+const waitPollInterval = time.Second
+
+// How long to wait for a TKey running another app to be plugged in
+// again, if not waiting for TKeys anyway.
+const otherAppWait = time.Minute
+
+// Devices keeps one Signer, and so one device session, for each TKey
+// plugged in. If the user passed a port or a serial number, only that
+// TKey is used.
+type Devices struct {
+	port      Port
+	opts      *SignerOptions
+	mu        sync.Mutex
+	ports     []tkeyclient.SerialPort // last seen, sorted by path
+	signers   map[string]*Signer      // by serial port path
+	watching  bool                    // getting hotplug events
+	detectErr error                   // from the last refresh
+	// Called, if set, in a goroutine of its own for the Signer of
+	// each TKey found, when it's first seen
+	onInsert  func(*Signer)
+	preloadMu sync.Mutex // one USS prompt at a time
+}
+
+func NewDevices(port Port, opts *SignerOptions, exitFunc func(int)) *Devices {
+	tkeyclient.SilenceLogging()
+
+	d := &Devices{
+		port:    port,
+		opts:    opts,
+		signers: map[string]*Signer{},
+	}
+
+	// Do nothing on HUP, in case old udev rule is still in effect
+	handleSignals(func() {}, syscall.SIGHUP)
+
+	handleReleaseSignal(d.releaseAll)
+
+	// Start handling signals here to catch abort during USS entering
+	handleSignals(func() {
+		d.closeAll()
+		exitFunc(1)
+	}, os.Interrupt, syscall.SIGTERM)
+
+	return d
+}
+
+// Signers returns a Signer for each TKey currently plugged in, sorted
+// by port. Finding none is left to the caller to report, see
+// notifyMissing.
+func (d *Devices) Signers() []*Signer {
+	d.mu.Lock()
+	watching := d.watching
+	d.mu.Unlock()
+
+	// Without hotplug events we have to look for changes every time
+	if !watching {
+		d.refresh()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	signers := make([]*Signer, 0, len(d.ports))
+	for _, p := range d.ports {
+		signers = append(signers, d.signers[p.DevPath])
+	}
+
+	return signers
+}
+
+// Status returns the status of each TKey currently plugged in, sorted
+// by port.
+func (d *Devices) Status() []SignerStatus {
+	signers := d.Signers()
+
+	status := make([]SignerStatus, 0, len(signers))
+	for _, signer := range signers {
+		status = append(status, signer.Status())
+	}
+
+	return status
+}
+
+// refresh looks for the TKeys plugged in and updates our Signers.
+// Signers of TKeys that have been removed are dropped, without
+// touching the others.
+func (d *Devices) refresh() {
+	ports, err := d.detect()
+	if err != nil {
+		notify(fmt.Sprintf("TKey detection failed: %s\n", err))
+		le.Printf("Failed to detect ports: %v\n", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.detectErr = err
+	if err != nil {
+		return
+	}
+
+	present := map[string]bool{}
+	for _, p := range ports {
+		present[p.DevPath] = true
+		if signer, ok := d.signers[p.DevPath]; ok {
+			if signer.port.Serial == p.SerialNumber {
+				continue
+			}
+			// Another TKey on the same port
+			signer.Close()
+		}
+
+		le.Printf("Found TKey on serial port %s\n", p.DevPath)
+		port := d.port
+		port.Path = p.DevPath
+		port.Serial = p.SerialNumber
+		signer := NewSigner(port, d.opts)
+		d.signers[p.DevPath] = signer
+		if d.onInsert != nil {
+			go d.onInsert(signer)
+		}
+	}
+
+	for path, signer := range d.signers {
+		if !present[path] {
+			le.Printf("TKey on serial port %s is gone\n", path)
+			signer.Close()
+			delete(d.signers, path)
+		}
+	}
+
+	d.ports = ports
+}
+
+// Watch starts following TKeys being plugged in and removed, so we
+// don't have to look for them on every operation. It returns an error
+// if that's not possible on this system, and we keep looking.
+func (d *Devices) Watch() error {
+	if d.port.Path != "" {
+		// Nothing to watch for, and it might not even be USB
+		return nil
+	}
+
+	// Start watching before taking stock, so nothing is missed
+	if err := watchHotplug(d.handleHotplug); err != nil {
+		return err
+	}
+
+	d.refresh()
+
+	d.mu.Lock()
+	d.watching = true
+	d.mu.Unlock()
+
+	return nil
+}
+
+// WatchSleep starts following system suspend and resume. Before the
+// system sleeps, the sessions with all TKeys are ended and forgotten,
+// as the TKeys likely lose power. After resume, we look for TKeys
+// again and call resumed. It returns an error if that's not possible
+// on this system.
+func (d *Devices) WatchSleep(resumed func()) error {
+	return watchSleep(func(sleeping bool) {
+		if sleeping {
+			le.Printf("System going to sleep, closing TKey connections\n")
+			d.forgetAll()
+			return
+		}
+
+		le.Printf("System resumed, looking for TKeys\n")
+		d.refresh()
+		if resumed != nil {
+			resumed()
+		}
+	})
+}
+
+// forgetAll ends the sessions with all TKeys and drops their Signers,
+// so that nothing known from before is trusted afterwards.
+func (d *Devices) forgetAll() {
+	d.mu.Lock()
+	signers := d.signers
+	d.signers = map[string]*Signer{}
+	d.ports = nil
+	d.mu.Unlock()
+
+	for _, signer := range signers {
+		signer.Close()
+	}
+	// Sleep is delayed meanwhile, so don't wait long in total
+	deadline := time.Now().Add(time.Second)
+	for _, signer := range signers {
+		signer.Wait(time.Until(deadline))
+	}
+}
+
+func (d *Devices) handleHotplug(ev HotplugEvent) {
+	d.mu.Lock()
+	signer := d.signers[ev.DevPath]
+	d.mu.Unlock()
+
+	switch ev.Action {
+	case HotplugAdd:
+		le.Printf("TKey plugged in on %s\n", ev.DevPath)
+		d.refresh()
+
+	case HotplugRemove:
+		if signer == nil {
+			// Not a TKey we were using
+			return
+		}
+
+		le.Printf("TKey on %s removed\n", ev.DevPath)
+		notify(fmt.Sprintf("%s removed.", signer.comment()))
+		d.refresh()
+
+	case HotplugRescan:
+		d.refresh()
+
+	case HotplugStopped:
+		le.Printf("Looking for TKeys on each request from now on\n")
+		d.mu.Lock()
+		d.watching = false
+		d.mu.Unlock()
+	}
+}
+
+// Preload makes the agent load the signer app onto each TKey as soon
+// as it's found, including those already plugged in, instead of on
+// first use. Any USS prompt then shows up right away.
+func (d *Devices) Preload() {
+	d.mu.Lock()
+	d.onInsert = d.preload
+	signers := make([]*Signer, 0, len(d.signers))
+	for _, signer := range d.signers {
+		signers = append(signers, signer)
+	}
+	d.mu.Unlock()
+
+	for _, signer := range signers {
+		go d.preload(signer)
+	}
+
+	// Without hotplug events, this is where we find them
+	d.Signers()
+}
+
+// preload connects to the TKey of signer and gets its public key,
+// loading the signer app if needed, and tells the user how it went.
+func (d *Devices) preload(signer *Signer) {
+	d.preloadMu.Lock()
+	defer d.preloadMu.Unlock()
+
+	le.Printf("Preloading TKey on %s\n", signer.port.Path)
+	if _, err := signer.PublicKey(); err != nil {
+		le.Printf("Preloading TKey on %s failed: %s\n", signer.port.Path, err)
+		notify(fmt.Sprintf("Could not get %s ready: %s", signer.yourTKey(), err))
+		return
+	}
+	le.Printf("Preloaded %s on %s, %s\n", signer.comment(), signer.port.Path, signer.State())
+	notify(fmt.Sprintf("Preloading done, %s is ready to use.", signer.yourTKey()))
+}
+
+// notifyMissing tells the user that no TKey was found.
+func (d *Devices) notifyMissing() {
+	if d.port.Serial != "" {
+		notify(fmt.Sprintf("Could not find the TKey with serial number %s.", d.port.Serial))
+	} else {
+		notify("Could not find any TKey plugged in.")
+	}
+	le.Printf("No TKey found\n")
+}
+
+// missing returns why no TKey was found.
+func (d *Devices) missing() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.detectErr != nil {
+		return d.detectErr
+	}
+
+	return ErrNoDevice
+}
+
+// Lookup returns the Signer of the TKey plugged in that has the
+// public key key. If there is none, the error tells why, from the
+// TKeys whose keys could not be read if any.
+func (d *Devices) Lookup(key ssh.PublicKey) (*Signer, error) {
+	signers := d.Signers()
+	if len(signers) == 0 {
+		return nil, d.missing()
+	}
+
+	var firstErr error
+	for _, signer := range signers {
+		match, err := keyMatches(signer, key)
+		if match {
+			return signer, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return nil, fmt.Errorf("%w with that public key", ErrNoDevice)
+}
+
+// WaitFor waits up to timeout for a TKey with the public key key to
+// be plugged in and loaded, and returns its Signer. It returns nil if
+// none shows up in time, or if ctx is done. purpose tells the user
+// what it's for.
+func (d *Devices) WaitFor(ctx context.Context, key ssh.PublicKey, timeout time.Duration, purpose string) *Signer {
+	if d.OtherAppMightHave(key) {
+		notify(fmt.Sprintf("Remove and plug in %s again to complete %s.", d.yourTKey(key), purpose))
+	} else {
+		notify(fmt.Sprintf("Insert %s to complete %s.", d.yourTKey(key), purpose))
+	}
+	le.Printf("Waiting up to %v for TKey to be inserted\n", timeout)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	// A TKey that has shown us another key won't change key while
+	// plugged in, so don't bother it again. Nor one that failed in a
+	// way that won't change until it's plugged in again, like a
+	// cancelled USS prompt, which would otherwise be shown again. A
+	// TKey plugged in again gets a new Signer, when we follow hotplug
+	// events.
+	tried := map[*Signer]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline.C:
+			notify("Gave up waiting for the TKey to be inserted.")
+			return nil
+		case <-ticker.C:
+		}
+
+		for _, signer := range d.Signers() {
+			if tried[signer] {
+				continue
+			}
+
+			match, err := keyMatches(signer, key)
+			if match {
+				le.Printf("TKey with the wanted key is now on %s\n", signer.port.Path)
+				return signer
+			}
+			if !temporary(err) {
+				tried[signer] = true
+			}
+		}
+	}
+}
+
+// temporary tells if err is a failure to read the key of a TKey that
+// might go away while it's still plugged in: another program using it,
+// it not answering, or it still running another app.
+func temporary(err error) bool {
+	return errors.Is(err, ErrPortBusy) || errors.Is(err, ErrDeviceTimeout) || errors.Is(err, ErrWrongApp)
+}
+
+// OtherAppMightHave tells if a TKey plugged in was found running some
+// other app than the signer, and might have the public key key once
+// plugged in again: key is cached for it, or nothing is.
+func (d *Devices) OtherAppMightHave(key ssh.PublicKey) bool {
+	for _, signer := range d.Signers() {
+		if signer.State() == stateOtherApp && d.mightHave(signer, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mightHave tells if the TKey of signer might have key, from the keys
+// cached for it by UDI or serial number.
+func (d *Devices) mightHave(signer *Signer, key ssh.PublicKey) bool {
+	if d.opts.Cache == nil {
+		return true
+	}
+
+	udi := signer.udiString()
+	cached := false
+	for _, entry := range d.opts.Cache.Entries() {
+		if (udi == "" || entry.UDI != udi) && (signer.port.Serial == "" || entry.Serial != signer.port.Serial) {
+			continue
+		}
+
+		sshPub, err := ssh.NewPublicKey(ed25519.PublicKey(entry.Pubkey))
+		if err == nil && bytes.Equal(key.Marshal(), sshPub.Marshal()) {
+			return true
+		}
+		cached = true
+	}
+
+	return !cached
+}
+
+// yourTKey returns how to refer to the TKey having key in messages to
+// the user, using its name if it's known from the cache.
+func (d *Devices) yourTKey(key ssh.PublicKey) string {
+	if d.opts.Cache == nil {
+		return "your TKey"
+	}
+
+	for _, entry := range d.opts.Cache.Entries() {
+		sshPub, err := ssh.NewPublicKey(ed25519.PublicKey(entry.Pubkey))
+		if err != nil || !bytes.Equal(key.Marshal(), sshPub.Marshal()) {
+			continue
+		}
+
+		if dev := d.opts.Conf.Device(entry.Serial, entry.UDI); dev != nil && dev.Name != "" {
+			return fmt.Sprintf("your TKey '%s'", dev.Name)
+		}
+	}
+
+	return "your TKey"
+}
+
+// keyMatches tells if the TKey of signer has the public key key. The
+// error tells why its key could not be read.
+func keyMatches(signer *Signer, key ssh.PublicKey) (bool, error) {
+	pub, err := signer.PublicKey()
+	if err != nil {
+		le.Printf("Getting public key from %s failed: %s\n", signer.port.Path, err)
+		return false, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		le.Printf("NewPublicKey: %s\n", err)
+		return false, fmt.Errorf("NewPublicKey: %w", err)
+	}
+
+	return bytes.Equal(key.Marshal(), sshPub.Marshal()), nil
+}
+
+// CachedPubkeys returns the cached public keys that would be the
+// result of loading a TKey with the current settings, together with a
+// comment for each.
+func (d *Devices) CachedPubkeys() ([]CachedPubkey, []string) {
+	if d.opts.Cache == nil {
+		return nil, nil
+	}
+
+	var pubkeys []CachedPubkey
+	var comments []string
+	touch := d.opts.touchDigests()
+
+	for _, entry := range d.opts.Cache.Entries() {
+		uss := d.opts.USS
+		dev := d.opts.Conf.Device(entry.Serial, entry.UDI)
+		if dev != nil {
+			uss = dev.ussConfig(uss)
+		}
+		if entry.USSProfile != uss.profile() || !dev.keyMatches(entry.Pubkey) {
+			continue
+		}
+
+		digest, err := d.opts.appDigest(entry.ProductID)
+		if err != nil || digest != entry.AppDigest {
+			continue
+		}
+
+		comment := fmt.Sprintf("TKey %s (cached)", entry.UDI)
+		if dev != nil && dev.Name != "" {
+			comment = fmt.Sprintf("TKey '%s' (cached)", dev.Name)
+		}
+		if !touch[entry.AppDigest] {
+			// Only used if allowed
+			comment += " (WARNING: signs without touch)"
+		}
+
+		pubkeys = append(pubkeys, entry)
+		comments = append(comments, comment)
+	}
+
+	return pubkeys, comments
+}
+
+// detect returns the serial ports of the TKeys we should use, sorted
+// by path.
+func (d *Devices) detect() ([]tkeyclient.SerialPort, error) {
+	ports, err := tkeyclient.GetSerialPorts()
+	if err != nil && d.port.Path == "" {
+		return nil, fmt.Errorf("GetSerialPorts: %w", err)
+	}
+
+	if d.port.Path != "" {
+		// The port might not be a USB device, e.g. when using QEMU,
+		// so just look for its serial number
+		for _, p := range ports {
+			if p.DevPath == d.port.Path {
+				return []tkeyclient.SerialPort{p}, nil
+			}
+		}
+		return []tkeyclient.SerialPort{{DevPath: d.port.Path}}, nil
+	}
+
+	found := make([]tkeyclient.SerialPort, 0, len(ports))
+	for _, p := range ports {
+		if d.port.Serial == "" || p.SerialNumber == d.port.Serial {
+			found = append(found, p)
+		}
+	}
+	if d.port.Serial != "" && len(found) > 1 {
+		// Can't tell which one the user meant
+		return nil, fmt.Errorf("%w with serial number %s", ErrManyDevices, d.port.Serial)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].DevPath < found[j].DevPath
+	})
+
+	return found, nil
+}
+
+// releaseAll closes the connections to all TKeys, so that other
+// programs can use them.
+func (d *Devices) releaseAll() {
+	d.mu.Lock()
+	signers := make([]*Signer, 0, len(d.signers))
+	for _, signer := range d.signers {
+		signers = append(signers, signer)
+	}
+	d.mu.Unlock()
+
+	for _, signer := range signers {
+		signer.Release()
+	}
+
+	notify("Released the TKey for other programs.")
+}
+
+func (d *Devices) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, signer := range d.signers {
+		signer.Close()
+	}
+	for _, signer := range d.signers {
+		signer.Wait(time.Second)
+	}
+}
+
+func handleSignals(action func(), sig ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	go func() {
+		for {
+			<-ch
+			action()
+		}
+	}()
+}
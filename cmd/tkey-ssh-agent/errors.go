@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import "errors"
+
+// Why talking to a TKey failed. Signer wraps these with details, test
+// with errors.Is.
+const (
+	ErrNoDevice       = constError("no TKey found")
+	ErrManyDevices    = constError("more than one TKey found")
+	ErrPortBusy       = constError("TKey is in use by another program")
+	ErrUnknownProduct = constError("unknown TKey product")
+	ErrUSSCancelled   = constError("USS entry cancelled")
+	ErrAppLoad        = constError("failed to load the signer app")
+	ErrWrongApp       = constError("TKey is running another app")
+	ErrDeviceTimeout  = constError("TKey did not respond in time")
+	ErrNoTouch        = constError("signer app not known to require touch")
+)
+
+// Exit status of --show-pubkey for each of the errors above. 1 is
+// any other failure, and 2 a usage error.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{ErrNoDevice, 3},
+	{ErrManyDevices, 4},
+	{ErrPortBusy, 5},
+	{ErrUnknownProduct, 6},
+	{ErrUSSCancelled, 7},
+	{ErrAppLoad, 8},
+	{ErrWrongApp, 9},
+	{ErrDeviceTimeout, 10},
+	{ErrNoTouch, 11},
+}
+
+// exitCode returns the exit status telling what err was about.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	for _, ec := range exitCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+
+	return 1
+}
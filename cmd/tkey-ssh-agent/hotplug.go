@@ -0,0 +1,22 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+type HotplugAction int
+
+const (
+	HotplugAdd HotplugAction = iota
+	HotplugRemove
+	// Events may have been missed, look for the TKeys again
+	HotplugRescan
+	// No more events will come
+	HotplugStopped
+)
+
+// HotplugEvent tells that the serial port of a TKey has appeared or
+// disappeared, or how following that went.
+type HotplugEvent struct {
+	Action  HotplugAction
+	DevPath string
+}
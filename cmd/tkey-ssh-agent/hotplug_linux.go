@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// USB vendor and product IDs of the TKey, as in system/60-tkey.rules.
+var tkeyUSBIDs = []struct {
+	vendor  uint64
+	product uint64
+}{
+	{0x1207, 0x8887},
+	{0x1209, 0x8885},
+}
+
+// Netlink multicast group of the uevents sent by the kernel itself,
+// as opposed to those sent by udev.
+const ueventKernelGroup = 1
+
+// How long to wait for udev to give us access to a new serial port,
+// and how often to check.
+const (
+	accessWait  = 5 * time.Second
+	accessRetry = 50 * time.Millisecond
+)
+
+// ueventReader delivers raw kernel uevent messages, one per call. The
+// netlink socket is one, tests use another.
+type ueventReader interface {
+	ReadUevent() ([]byte, error)
+}
+
+// watchHotplug calls handle, from a goroutine of its own, for every
+// TKey serial port appearing or disappearing. Removals might also be
+// reported for other serial ports. If events are lost, handle gets
+// HotplugRescan, and if we can't follow them any longer,
+// HotplugStopped.
+func watchHotplug(handle func(HotplugEvent)) error {
+	r, err := newNetlinkUevents()
+	if err != nil {
+		return err
+	}
+
+	go followUevents(r, newTKeyUevents(), handle)
+
+	return nil
+}
+
+func followUevents(r ueventReader, t *tkeyUevents, handle func(HotplugEvent)) {
+	for {
+		msg, err := r.ReadUevent()
+		if errors.Is(err, unix.ENOBUFS) {
+			// The socket buffer overflowed during a burst of events
+			le.Printf("Lost hotplug events, looking for TKeys again\n")
+			handle(HotplugEvent{Action: HotplugRescan})
+			continue
+		}
+		if err != nil {
+			le.Printf("Stopped following hotplug events: %s\n", err)
+			handle(HotplugEvent{Action: HotplugStopped})
+			return
+		}
+
+		ev, err := parseUevent(msg)
+		if err != nil {
+			le.Printf("Ignoring uevent: %s\n", err)
+			continue
+		}
+
+		hev, ok := t.handle(ev)
+		if !ok {
+			continue
+		}
+
+		if hev.Action == HotplugAdd {
+			// The kernel tells before udev has set the permissions
+			// of the device node, so opening it now might fail
+			go func() {
+				waitAccessible(hev.DevPath)
+				handle(hev)
+			}()
+			continue
+		}
+
+		handle(hev)
+	}
+}
+
+// waitAccessible waits up to accessWait for the device node at
+// devPath to be readable and writable by us.
+func waitAccessible(devPath string) {
+	deadline := time.Now().Add(accessWait)
+	for unix.Access(devPath, unix.R_OK|unix.W_OK) != nil {
+		if time.Now().After(deadline) {
+			le.Printf("No access to %s after %v, trying anyway\n", devPath, accessWait)
+			return
+		}
+		time.Sleep(accessRetry)
+	}
+}
+
+type netlinkUevents struct {
+	fd  int
+	buf []byte
+}
+
+func newNetlinkUevents() (*netlinkUevents, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+
+	return &netlinkUevents{fd: fd, buf: make([]byte, 64*1024)}, nil
+}
+
+func (n *netlinkUevents) ReadUevent() ([]byte, error) {
+	for {
+		l, from, err := unix.Recvfrom(n.fd, n.buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("netlink recvfrom: %w", err)
+		}
+
+		// Only trust messages from the kernel
+		if sa, ok := from.(*unix.SockaddrNetlink); !ok || sa.Pid != 0 {
+			continue
+		}
+
+		return bytes.Clone(n.buf[:l]), nil
+	}
+}
+
+type uevent struct {
+	action string
+	env    map[string]string
+}
+
+// parseUevent parses a kernel uevent message, which looks like
+// "add@/devices/...\0ACTION=add\0DEVPATH=/devices/...\0...".
+func parseUevent(msg []byte) (uevent, error) {
+	fields := strings.Split(strings.TrimRight(string(msg), "\x00"), "\x00")
+
+	if !strings.Contains(fields[0], "@") {
+		return uevent{}, fmt.Errorf("bad header %q", fields[0])
+	}
+
+	ev := uevent{env: map[string]string{}}
+	for _, field := range fields[1:] {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		ev.env[k] = v
+	}
+
+	ev.action = ev.env["ACTION"]
+	if ev.action == "" || ev.env["DEVPATH"] == "" {
+		return uevent{}, fmt.Errorf("missing ACTION or DEVPATH in %q", fields[0])
+	}
+
+	return ev, nil
+}
+
+// tkeyUevents picks out the uevents of TKey serial ports. The kernel
+// reports the USB device before its serial port, so we remember which
+// USB devices are TKeys to be able to tell if a port belongs to one.
+type tkeyUevents struct {
+	usbDevPaths map[string]bool
+}
+
+func newTKeyUevents() *tkeyUevents {
+	return &tkeyUevents{usbDevPaths: map[string]bool{}}
+}
+
+func (t *tkeyUevents) handle(ev uevent) (HotplugEvent, bool) {
+	devPath := ev.env["DEVPATH"]
+
+	switch ev.env["SUBSYSTEM"] {
+	case "usb":
+		switch ev.action {
+		case "add":
+			if isTKeyProduct(ev.env["PRODUCT"]) {
+				t.usbDevPaths[devPath] = true
+			}
+		case "remove":
+			delete(t.usbDevPaths, devPath)
+		}
+
+	case "tty":
+		devName := ev.env["DEVNAME"]
+		if devName == "" {
+			return HotplugEvent{}, false
+		}
+		port := path.Join("/dev", devName)
+
+		switch ev.action {
+		case "add":
+			for usb := range t.usbDevPaths {
+				if strings.HasPrefix(devPath, usb+"/") {
+					return HotplugEvent{Action: HotplugAdd, DevPath: port}, true
+				}
+			}
+		case "remove":
+			// Its USB device might already be gone, so we can't
+			// tell if it was a TKey
+			return HotplugEvent{Action: HotplugRemove, DevPath: port}, true
+		}
+	}
+
+	return HotplugEvent{}, false
+}
+
+// isTKeyProduct tells if the PRODUCT value of a USB uevent, like
+// "1207/8887/300" (vendor/product/bcdDevice in hex), is a TKey.
+func isTKeyProduct(product string) bool {
+	parts := strings.Split(product, "/")
+	if len(parts) != 3 {
+		return false
+	}
+
+	vendor, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return false
+	}
+	prod, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return false
+	}
+
+	for _, id := range tkeyUSBIDs {
+		if id.vendor == vendor && id.product == prod {
+			return true
+		}
+	}
+
+	return false
+}
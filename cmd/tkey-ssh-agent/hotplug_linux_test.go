@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testUSBDevPath = "/devices/pci0000:00/0000:00:14.0/usb1/1-2"
+	testTTYDevPath = testUSBDevPath + "/1-2:1.0/tty/ttyACM0"
+)
+
+// testUevent builds a kernel uevent message with the given variables.
+func testUevent(action string, devPath string, vars ...string) []byte {
+	fields := []string{action + "@" + devPath, "ACTION=" + action, "DEVPATH=" + devPath}
+	fields = append(fields, vars...)
+
+	return []byte(strings.Join(fields, "\x00") + "\x00")
+}
+
+func usbUevent(action string, product string) []byte {
+	return testUevent(action, testUSBDevPath, "SUBSYSTEM=usb", "DEVTYPE=usb_device", "PRODUCT="+product)
+}
+
+func ttyUevent(action string) []byte {
+	return testUevent(action, testTTYDevPath, "SUBSYSTEM=tty", "DEVNAME=ttyACM0", "MAJOR=166", "MINOR=0")
+}
+
+func TestTKeyUevents(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs [][]byte
+		want []HotplugEvent
+	}{
+		{
+			name: "TKey inserted and removed",
+			msgs: [][]byte{
+				usbUevent("add", "1207/8887/300"),
+				ttyUevent("add"),
+				ttyUevent("remove"),
+				usbUevent("remove", "1207/8887/300"),
+			},
+			want: []HotplugEvent{
+				{Action: HotplugAdd, DevPath: "/dev/ttyACM0"},
+				{Action: HotplugRemove, DevPath: "/dev/ttyACM0"},
+			},
+		},
+		{
+			name: "other USB IDs of the TKey",
+			msgs: [][]byte{
+				usbUevent("add", "1209/8885/100"),
+				ttyUevent("add"),
+			},
+			want: []HotplugEvent{
+				{Action: HotplugAdd, DevPath: "/dev/ttyACM0"},
+			},
+		},
+		{
+			name: "other product ignored",
+			msgs: [][]byte{
+				usbUevent("add", "2341/0043/1"),
+				ttyUevent("add"),
+			},
+		},
+		{
+			name: "serial port of a removed TKey ignored",
+			msgs: [][]byte{
+				usbUevent("add", "1207/8887/300"),
+				usbUevent("remove", "1207/8887/300"),
+				ttyUevent("add"),
+			},
+		},
+		{
+			name: "removal of a port not seen added",
+			msgs: [][]byte{
+				ttyUevent("remove"),
+			},
+			want: []HotplugEvent{
+				{Action: HotplugRemove, DevPath: "/dev/ttyACM0"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := newTKeyUevents()
+
+			var got []HotplugEvent
+			for _, msg := range tt.msgs {
+				ev, err := parseUevent(msg)
+				if err != nil {
+					t.Fatalf("parseUevent: %s", err)
+				}
+				if hev, ok := tk.handle(ev); ok {
+					got = append(got, hev)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d: got %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseUeventBad(t *testing.T) {
+	for _, msg := range []string{
+		"libudev\x00whatever",
+		"add@/devices/x\x00SUBSYSTEM=usb\x00",
+	} {
+		if _, err := parseUevent([]byte(msg)); err == nil {
+			t.Errorf("parseUevent(%q) succeeded", msg)
+		}
+	}
+}
+
+// fakeUevents hands out messages, or errors, in order.
+type fakeUevents struct {
+	reads []fakeRead
+}
+
+type fakeRead struct {
+	msg []byte
+	err error
+}
+
+func (f *fakeUevents) ReadUevent() ([]byte, error) {
+	if len(f.reads) == 0 {
+		return nil, unix.EBADF
+	}
+	r := f.reads[0]
+	f.reads = f.reads[1:]
+
+	return r.msg, r.err
+}
+
+func TestFollowUevents(t *testing.T) {
+	r := &fakeUevents{reads: []fakeRead{
+		{msg: []byte("garbage")},
+		{msg: ttyUevent("remove")},
+		{err: unix.ENOBUFS},
+		{msg: ttyUevent("remove")},
+		{err: unix.EIO},
+		{msg: ttyUevent("remove")},
+	}}
+
+	var got []HotplugEvent
+	followUevents(r, newTKeyUevents(), func(hev HotplugEvent) {
+		got = append(got, hev)
+	})
+
+	want := []HotplugEvent{
+		{Action: HotplugRemove, DevPath: "/dev/ttyACM0"},
+		{Action: HotplugRescan},
+		{Action: HotplugRemove, DevPath: "/dev/ttyACM0"},
+		{Action: HotplugStopped},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
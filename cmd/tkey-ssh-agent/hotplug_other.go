@@ -0,0 +1,12 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchHotplug(_ func(HotplugEvent)) error {
+	return errors.New("hotplug events not supported on this system")
+}
@@ -0,0 +1,285 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How long to wait for a running agent to answer.
+const dialTimeout = 5 * time.Second
+
+// DeviceReport is what --list-ports tells about one TKey. Only the
+// port and serial number are there without --details, and only what
+// could be found out with it.
+type DeviceReport struct {
+	Port              string  `json:"port"`
+	SerialNumber      string  `json:"serial_number,omitempty"`
+	UDI               string  `json:"udi,omitempty"`
+	UDISource         string  `json:"udi_source,omitempty"`
+	ProductID         *uint8  `json:"product_id,omitempty"`
+	Product           string  `json:"product,omitempty"`
+	FirmwareName      string  `json:"firmware_name,omitempty"`
+	FirmwareVersion   *uint32 `json:"firmware_version,omitempty"`
+	Mode              string  `json:"mode,omitempty"`
+	AppName           string  `json:"app_name,omitempty"`
+	AppVersion        *uint32 `json:"app_version,omitempty"`
+	Fingerprint       string  `json:"fingerprint,omitempty"`
+	FingerprintSource string  `json:"fingerprint_source,omitempty"`
+	Error             string  `json:"error,omitempty"`
+	// What the agent at SSH_AUTH_SOCK says about the TKey, if it's
+	// ours
+	Agent *SignerStatus `json:"agent,omitempty"`
+}
+
+// listDevicesCommand lists the TKeys, asking each of them what it is
+// doing if details is set, and returns the exit code. It fails only if
+// there were no TKeys.
+func listDevicesCommand(devices *Devices, details bool, jsonOut bool) int {
+	signers := devices.Signers()
+	if len(signers) == 0 {
+		le.Printf("No TKey serial ports found.\n")
+		if jsonOut {
+			fmt.Println("[]")
+		}
+		return 1
+	}
+
+	var running map[string]SignerStatus
+	if details {
+		running = runningAgentStatus()
+	}
+
+	reports := make([]DeviceReport, 0, len(signers))
+	for _, signer := range signers {
+		report := DeviceReport{
+			Port:         signer.port.Path,
+			SerialNumber: signer.port.Serial,
+		}
+		if details {
+			report.probe(devices, signer)
+			if status, ok := running[signer.port.Path]; ok {
+				report.Agent = &status
+			}
+		}
+		reports = append(reports, report)
+	}
+	devices.closeAll()
+
+	if jsonOut {
+		out, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			le.Printf("Marshal: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%s\n", out)
+		return 0
+	}
+
+	le.Printf("TKey serial ports (on stdout):\n")
+	for _, report := range reports {
+		report.print()
+	}
+
+	return 0
+}
+
+// probe fills in what signer's TKey tells about itself, and its
+// fingerprint if the signer app is running or the public key is pinned
+// or in the devices cache. The UDI is only told by the firmware, so in
+// app mode it is looked up in the cache by the public key.
+func (r *DeviceReport) probe(devices *Devices, signer *Signer) {
+	probe, err := signer.Probe()
+	if err != nil {
+		le.Printf("Probing TKey on %s failed: %s\n", signer.port.Path, err)
+		r.Error = err.Error()
+		return
+	}
+
+	r.Mode = "app"
+	if probe.firmware != nil {
+		r.Mode = "firmware"
+		r.FirmwareName = appName(probe.firmware)
+		r.FirmwareVersion = &probe.firmware.Version
+	}
+
+	if probe.app != nil {
+		r.AppName = appName(probe.app)
+		r.AppVersion = &probe.app.Version
+	}
+
+	udi := ""
+	if probe.udi != nil {
+		udi = probe.udi.String()
+		r.UDI = udi
+		r.UDISource = "device"
+		r.ProductID = &probe.udi.ProductID
+		r.Product = productNames[probe.udi.ProductID]
+	} else if probe.pubkey != nil && devices.opts.Cache != nil {
+		if entry := devices.opts.Cache.Find(probe.pubkey); entry != nil {
+			udi = entry.UDI
+			r.UDI = udi
+			r.UDISource = "cached"
+			r.ProductID = &entry.ProductID
+			r.Product = productNames[entry.ProductID]
+		}
+	}
+
+	if probe.pubkey != nil {
+		if sshPub, err := ssh.NewPublicKey(probe.pubkey); err == nil {
+			r.Fingerprint = ssh.FingerprintSHA256(sshPub)
+			r.FingerprintSource = "app"
+			return
+		}
+	}
+
+	if dev := signer.opts.Conf.Device(signer.port.Serial, udi); dev != nil && dev.pinned != nil {
+		r.Fingerprint = ssh.FingerprintSHA256(dev.pinned)
+		r.FingerprintSource = "pinned"
+		return
+	}
+
+	if udi == "" {
+		return
+	}
+	pubkeys, _ := devices.CachedPubkeys()
+	for _, entry := range pubkeys {
+		if !strings.EqualFold(entry.UDI, udi) {
+			continue
+		}
+		sshPub, err := ssh.NewPublicKey(ed25519.PublicKey(entry.Pubkey))
+		if err != nil {
+			continue
+		}
+		r.Fingerprint = ssh.FingerprintSHA256(sshPub)
+		r.FingerprintSource = "cached"
+		return
+	}
+}
+
+// runningAgentStatus asks the agent at SSH_AUTH_SOCK for the status of
+// its TKeys, by port. It returns nil if there is no such agent, or it
+// isn't tkey-ssh-agent.
+func runningAgentStatus() map[string]SignerStatus {
+	path := os.Getenv("SSH_AUTH_SOCK")
+	if path == "" {
+		return nil
+	}
+
+	conn, err := nativeDial(path)
+	if err != nil {
+		le.Printf("No agent at SSH_AUTH_SOCK: %s\n", err)
+		return nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	res, err := agent.NewClient(conn).Extension(statusExtension, nil)
+	if errors.Is(err, agent.ErrExtensionUnsupported) {
+		// Another agent
+		return nil
+	} else if err != nil {
+		le.Printf("Asking the agent for its status failed: %s\n", err)
+		return nil
+	}
+
+	var status []SignerStatus
+	if len(res) == 0 || res[0] != agentSuccess || json.Unmarshal(res[1:], &status) != nil {
+		le.Printf("Bad status from the agent\n")
+		return nil
+	}
+
+	running := map[string]SignerStatus{}
+	for _, s := range status {
+		running[s.Port] = s
+	}
+
+	return running
+}
+
+func (r *DeviceReport) print() {
+	fmt.Printf("%s serialNumber:%s\n", r.Port, r.SerialNumber)
+
+	if r.Error != "" {
+		fmt.Printf("  Error:       %s\n", r.Error)
+		r.printAgent()
+		return
+	}
+	if r.Mode == "" {
+		// No --details
+		return
+	}
+
+	if r.UDI == "" {
+		fmt.Printf("  UDI:         unknown in app mode\n")
+	} else {
+		source := ""
+		if r.UDISource == "cached" {
+			source = " (cached)"
+		}
+		fmt.Printf("  UDI:         %s%s\n", r.UDI, source)
+		product := r.Product
+		if product == "" {
+			product = "unknown"
+		}
+		fmt.Printf("  Product:     %s (%d)\n", product, *r.ProductID)
+	}
+	if r.FirmwareVersion != nil {
+		fmt.Printf("  Firmware:    %s version %d\n", r.FirmwareName, *r.FirmwareVersion)
+	}
+	fmt.Printf("  Mode:        %s\n", r.Mode)
+	if r.Mode == "app" {
+		if r.AppVersion != nil {
+			fmt.Printf("  App:         %s version %d\n", r.AppName, *r.AppVersion)
+		} else {
+			fmt.Printf("  App:         unknown, not the signer app\n")
+		}
+	}
+	if r.Fingerprint != "" {
+		fmt.Printf("  Fingerprint: %s (%s)\n", r.Fingerprint, r.FingerprintSource)
+	}
+	r.printAgent()
+}
+
+// printAgent prints what the running agent says about the TKey, if
+// anything.
+func (r *DeviceReport) printAgent() {
+	if r.Agent == nil {
+		return
+	}
+
+	state := r.Agent.State
+	if state == stateAbsent.String() {
+		// It disconnects when idle
+		state = "not connected"
+	}
+	if r.Agent.Loaded {
+		state += ", running the app the agent loaded"
+	}
+	if r.Agent.NoTouch {
+		state += ", signs without touch"
+	} else if r.Agent.TouchUnverified {
+		state += ", touch not verified"
+	}
+	fmt.Printf("  Agent:       %s\n", state)
+	if r.Agent.Error != "" {
+		fmt.Printf("  Agent error: %s\n", r.Agent.Error)
+	}
+}
+
+// appName returns the name that an app, or the firmware, answers
+// with, as one string.
+func appName(nameVer *tkeyclient.NameVersion) string {
+	return strings.TrimSpace(nameVer.Name0) + " " + strings.TrimSpace(nameVer.Name1)
+}
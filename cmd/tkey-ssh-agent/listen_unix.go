@@ -11,6 +11,15 @@ import (
 	"syscall"
 )
 
+// nativeDial connects to the UNIX-domain socket at path.
+func nativeDial(path string) (net.Conn, error) {
+	c, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	return c, nil
+}
+
 func nativeListen(path string) (net.Listener, error) {
 	syscall.Umask(0o077)
 
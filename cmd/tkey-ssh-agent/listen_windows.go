@@ -13,6 +13,16 @@ import (
 	"github.com/Microsoft/go-winio"
 )
 
+// nativeDial connects to the Named Pipe at path.
+func nativeDial(path string) (net.Conn, error) {
+	timeout := dialTimeout
+	c, err := winio.DialPipe(path, &timeout)
+	if err != nil {
+		return nil, fmt.Errorf("DialPipe: %w", err)
+	}
+	return c, nil
+}
+
 func nativeListen(path string) (net.Listener, error) {
 	// Create a SecurityDescriptor that makes the named pipe created
 	// by ListenPipe accessible only by the current user
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/tillitis/tkeyclient"
@@ -27,8 +28,9 @@ var version string
 const windowsPipePrefix = `\\.\pipe\`
 
 type Port struct {
-	Path  string
-	Speed int
+	Path   string
+	Serial string
+	Speed  int
 }
 
 type UssConfig struct {
@@ -49,8 +51,14 @@ func main() {
 
 	var port Port
 	var ussConf UssConfig
-	var agentPath string
+	var agentPath, brokerPath, configPath string
+	var appFile AppFile
+	var touchTimeout, waitForTKey time.Duration
+	var idleDisconnect, deviceTimeout time.Duration
+	var stayConnected, preload, allowNoTouch, lockOnResume bool
 	var showPubkeyOnly, listPortsOnly, versionOnly, helpOnly bool
+	var listDetails, listJSON bool
+	var cachePubkeys bool
 	pflag.CommandLine.SetOutput(os.Stderr)
 	pflag.CommandLine.SortFlags = false
 	pflag.CommandLine.SetNormalizeFunc(func(_ *pflag.FlagSet, name string) pflag.NormalizedName {
@@ -62,12 +70,20 @@ func main() {
 	})
 	pflag.StringVarP(&agentPath, "agent-path", "a", "",
 		fmt.Sprintf("Start the agent, setting the `PATH` to the UNIX-domain socket that it should listen on. On Windows, a Named Pipe at '%s\\PATH' will be used.", windowsPipePrefix))
+	pflag.StringVar(&brokerPath, "broker-path", "",
+		"With -a, also listen on `PATH` for other local programs to get public keys and signatures from the TKey, see the manual page for the protocol.")
 	pflag.BoolVarP(&showPubkeyOnly, "show-pubkey", "p", false,
 		"Don't start the agent, only output the ssh-ed25519 public key.")
 	pflag.BoolVarP(&listPortsOnly, "list-ports", "L", false,
 		"List possible serial ports to use with --port.")
+	pflag.BoolVar(&listDetails, "details", false,
+		"With -L, connect to each TKey and also tell its UDI, product, firmware version, whether it's in firmware or app mode, what app it's running, and the SSH key fingerprint if pinned or cached. Doesn't load any app.")
+	pflag.BoolVar(&listJSON, "json", false,
+		"With -L, output the list in JSON.")
 	pflag.StringVar(&port.Path, "port", "",
-		"Set serial port device `PATH`. If this is not passed, auto-detection will be attempted.")
+		"Set serial port device `PATH`, or tcp://host:port for a TKey on the network (Linux only). If this is not passed, all TKeys plugged in are used.")
+	pflag.StringVar(&port.Serial, "serial-number", "",
+		"Only use the TKey with USB serial number `SERIAL`, as shown by --list-ports.")
 	pflag.IntVar(&port.Speed, "speed", 0,
 		"Set serial port speed in `BPS` (bits per second).")
 	pflag.BoolVar(&ussConf.EnterManually, "uss", false,
@@ -78,10 +94,36 @@ func main() {
 		"Read `FILE` and hash its contents as the USS. Use '-' (dash) to read from stdin. The full contents are hashed unmodified (e.g. newlines are not stripped).")
 	pflag.StringVar(&ussConf.PinentryPath, "pinentry", "",
 		"Pinentry `PROGRAM` for use by --uss. The default is found by looking in your gpg-agent.conf for pinentry-program, or 'pinentry' if not found there. On Windows, an attempt is made to find Gpg4win's pinentry program to use as default. On macOS, a native prompt is used by default.")
+	pflag.StringVar(&appFile.Path, "app-file", "",
+		"Load the signer app in `FILE` instead of the embedded one, on all TKeys. Needs --app-digest.")
+	pflag.StringVar(&appFile.Digest, "app-digest", "",
+		"The SHA512 `DIGEST` of the app in --app-file, in hex. Any other app is refused.")
+	pflag.StringVar(&configPath, "config", "",
+		fmt.Sprintf("Read configuration from `FILE`. The default is %s, if it exists.", defaultConfigPath()))
+	pflag.DurationVar(&touchTimeout, "touch-timeout", 0,
+		"Cancel a signature if the TKey has not been touched within `DURATION` (e.g. 30s). The default 0 means wait until the client gives up.")
+	pflag.DurationVar(&idleDisconnect, "idle-disconnect", defaultIdleDisconnect,
+		"Disconnect from the TKey after being idle for `DURATION`, so that other programs can use it.")
+	pflag.DurationVar(&deviceTimeout, "device-timeout", defaultDeviceTimeout,
+		"Give up on the TKey if it doesn't answer within `DURATION`, except when waiting for a touch. The connection is then reset and the operation tried once more.")
+	pflag.BoolVar(&stayConnected, "stay-connected", false,
+		"Keep the connection to the TKey open for as long as it is plugged in, instead of disconnecting when idle. Other programs can't use the TKey meanwhile. On Unix, send SIGUSR1 to the agent to release it.")
+	pflag.BoolVar(&preload, "preload", false,
+		"With -a, connect to each TKey and load the signer app as soon as it's found, at startup and when plugged in, instead of on first use. Any USS prompt then shows up right away.")
+	pflag.BoolVar(&allowNoTouch, "allow-no-touch", false,
+		"Use signer apps that are not known to require touching the TKey to sign. Dangerous: anything on this machine that can reach the agent can then sign without you noticing.")
+	pflag.BoolVar(&lockOnResume, "lock-on-resume", false,
+		"With -a, lock the agent when the computer resumes from sleep, until you confirm your presence with pinentry at the next use (Linux only).")
+	pflag.DurationVar(&waitForTKey, "wait-for-tkey", 0,
+		"If no TKey with the requested key is plugged in when asked to sign, ask the user to insert it and wait up to `DURATION` (e.g. 1m) for it. Best used with --pubkey-cache.")
+	pflag.BoolVar(&cachePubkeys, "pubkey-cache", false,
+		fmt.Sprintf("Remember the public key of each TKey in %s, so that it can be listed even when the TKey is not plugged in.", defaultPubkeyCachePath()))
 	pflag.BoolVar(&versionOnly, "version", false, "Output version information.")
 	pflag.BoolVar(&helpOnly, "help", false, "Output this help.")
 	pflag.Usage = func() {
 		desc := fmt.Sprintf(`Usage: %[1]s -a|-p|-L [flags...]
+       %[1]s apps [list | extract VERSION FILE | verify FILE [DIGESTS]]
+       %[1]s verify-device DATA VENDOR_KEYS [FIRMWARE_SIZE]
 
 %[1]s is an alternative SSH agent that communicates with a Tillitis TKey
 USB stick. This stick holds private key and signing functionality for public key
@@ -100,29 +142,47 @@ will flash green when the stick must be touched to complete a signature.`, progn
 	}
 	pflag.Parse()
 
-	if pflag.NArg() > 0 {
+	if pflag.NArg() > 0 && pflag.Arg(0) == "apps" {
+		exit(appsCommand(pflag.Args()[1:]))
+	}
+
+	verifyOnly := pflag.NArg() > 0 && pflag.Arg(0) == "verify-device"
+
+	if pflag.NArg() > 0 && !verifyOnly {
 		le.Printf("Unexpected argument: %s\n\n", strings.Join(pflag.Args(), " "))
 		pflag.Usage()
 		exit(2)
 	}
 
 	if signerAppNoTouch != "" {
-		le.Printf("WARNING! This tkey-ssh-agent and signer app is built with the touch requirement removed\n")
+		le.Printf("WARNING! This tkey-ssh-agent and signer app is built with the touch requirement removed. It needs --allow-no-touch.\n")
 	}
 	if helpOnly {
 		pflag.Usage()
 		exit(0)
 	}
 
+	appsErr := CheckApps()
+
 	if versionOnly {
 		fmt.Printf("%s %s\n\n", progname, version)
 		fmt.Printf("Embedded device apps:\n")
 		for _, app := range ListApps() {
 			fmt.Printf("%s\nSHA512: %s\n", app.name, app.digest)
 		}
+		if appsErr != nil {
+			fmt.Printf("\nIntegrity check FAILED: %s\n", appsErr)
+			exit(1)
+		}
+		fmt.Printf("\nIntegrity check passed, digests match signers.sha512.\n")
 		exit(0)
 	}
 
+	if appsErr != nil {
+		le.Printf("Embedded device apps failed integrity check, refusing to run: %s\n", appsErr)
+		exit(1)
+	}
+
 	exclusive := 0
 	if agentPath != "" {
 		exclusive++
@@ -133,13 +193,22 @@ will flash green when the stick must be touched to complete a signature.`, progn
 	if listPortsOnly {
 		exclusive++
 	}
+	if verifyOnly {
+		exclusive++
+	}
 	if exclusive > 1 {
-		le.Printf("Pass only one of -a, -p, or -L.\n\n")
+		le.Printf("Pass only one of -a, -p, -L, or verify-device.\n\n")
 		pflag.Usage()
 		exit(2)
 	}
 
-	if listPortsOnly {
+	if (listDetails || listJSON) && !listPortsOnly {
+		le.Printf("--details and --json need -L.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if listPortsOnly && !listDetails && !listJSON {
 		n, err := printPorts()
 		if err != nil {
 			le.Printf("%v\n", err)
@@ -151,57 +220,218 @@ will flash green when the stick must be touched to complete a signature.`, progn
 		exit(0)
 	}
 
-	if !showPubkeyOnly && agentPath == "" {
+	if !showPubkeyOnly && agentPath == "" && !verifyOnly && !listPortsOnly {
 		le.Printf("Please pass at least -a or -p.\n\n")
 		pflag.Usage()
 		exit(2)
 	}
 
+	if brokerPath != "" && agentPath == "" {
+		le.Printf("--broker-path needs -a.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if preload && agentPath == "" {
+		le.Printf("--preload needs -a.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if lockOnResume && agentPath == "" {
+		le.Printf("--lock-on-resume needs -a.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
 	if ussConf.EnterManually && ussConf.Path != "" {
 		le.Printf("Pass only one of --uss or --uss-file.\n\n")
 		pflag.Usage()
 		exit(2)
 	}
 
+	if (appFile.Path == "") != (appFile.Digest == "") {
+		le.Printf("Pass both --app-file and --app-digest, or neither.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if appFile.Path != "" {
+		if !validDigest(appFile.Digest) {
+			le.Printf("--app-digest needs the SHA512 digest in hex.\n\n")
+			pflag.Usage()
+			exit(2)
+		}
+		if _, err := appFile.Read(); err != nil {
+			le.Printf("Refusing to use signer app: %s\n", err)
+			exit(1)
+		}
+	}
+
+	if isNetworkPort(port.Path) {
+		if _, err := parseNetworkPort(port.Path); err != nil {
+			le.Printf("--port: %s\n\n", err)
+			pflag.Usage()
+			exit(2)
+		}
+	}
+
+	if port.Path != "" && port.Serial != "" {
+		le.Printf("Pass only one of --port or --serial-number.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if verifyOnly {
+		var af *AppFile
+		if appFile.Path != "" {
+			af = &appFile
+		}
+		exit(verifyDeviceCommand(pflag.Args()[1:], port, af))
+	}
+
+	if idleDisconnect <= 0 {
+		le.Printf("--idle-disconnect must be positive, see also --stay-connected.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	if deviceTimeout <= 0 {
+		le.Printf("--device-timeout must be positive.\n\n")
+		pflag.Usage()
+		exit(2)
+	}
+
+	mustExist := true
+	if configPath == "" {
+		configPath = defaultConfigPath()
+		mustExist = false
+	}
+	conf, err := LoadConfig(configPath, mustExist)
+	if err != nil {
+		le.Printf("Failed to load config: %s\n", err)
+		exit(1)
+	}
+
 	prevExitFunc := exit
 	exit = func(code int) {
 		_ = os.Remove(agentPath)
+		if brokerPath != "" {
+			_ = os.Remove(brokerPath)
+		}
 		prevExitFunc(code)
 	}
 
-	signer := NewSigner(port, ussConf, exit)
+	opts := SignerOptions{
+		USS:            ussConf,
+		TouchTimeout:   touchTimeout,
+		IdleDisconnect: idleDisconnect,
+		DeviceTimeout:  deviceTimeout,
+		StayConnected:  stayConnected,
+		Conf:           conf,
+		AllowNoTouch:   allowNoTouch,
+	}
+	if appFile.Path != "" {
+		opts.AppFile = &appFile
+	}
+	if cachePubkeys {
+		path := defaultPubkeyCachePath()
+		if path == "" {
+			le.Printf("No place to keep the pubkey cache in.\n")
+			prevExitFunc(1)
+		}
+		opts.Cache = NewPubkeyCache(path)
+	} else if listDetails {
+		// Only read, for the fingerprints
+		if path := defaultPubkeyCachePath(); path != "" {
+			opts.Cache = NewPubkeyCache(path)
+		}
+	}
+
+	devices := NewDevices(port, &opts, exit)
+
+	if listPortsOnly {
+		prevExitFunc(listDevicesCommand(devices, listDetails, listJSON))
+	}
 
 	if showPubkeyOnly {
-		if !signer.connect() {
-			le.Printf("Connect failed")
-			prevExitFunc(1)
+		signers := devices.Signers()
+		if len(signers) == 0 {
+			err := devices.missing()
+			if errors.Is(err, ErrNoDevice) {
+				devices.notifyMissing()
+			}
+			le.Printf("Connect failed: %s\n", err)
+			prevExitFunc(exitCode(err))
 		}
-		signer.printAuthorizedKey()
-		signer.closeNow()
-		prevExitFunc(0)
+		// The first failure decides the exit status
+		var firstErr error
+		for _, signer := range signers {
+			if err := signer.printAuthorizedKey(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		devices.closeAll()
+		prevExitFunc(exitCode(firstErr))
 	}
 
-	if runtime.GOOS == "windows" {
-		agentPath = filepath.Join(windowsPipePrefix, agentPath)
-	} else {
-		var err error
-		agentPath, err = filepath.Abs(agentPath)
-		if err != nil {
-			le.Printf("Failed to resolve socket path: %s", err)
+	for _, path := range []*string{&agentPath, &brokerPath} {
+		if *path == "" {
+			continue
+		}
+
+		if runtime.GOOS == "windows" {
+			*path = filepath.Join(windowsPipePrefix, *path)
+		} else {
+			*path, err = filepath.Abs(*path)
+			if err != nil {
+				le.Printf("Failed to resolve socket path: %s", err)
+				prevExitFunc(1)
+			}
+		}
+
+		_, err = os.Stat(*path)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			msg := fmt.Sprintf("Is an agent already running? Path %s exists.", *path)
+			notify(msg)
+			le.Printf("%s\n", msg)
+			// Don't remove the socket for the agent running.
 			prevExitFunc(1)
 		}
 	}
 
-	_, err := os.Stat(agentPath)
-	if err == nil || !errors.Is(err, os.ErrNotExist) {
-		msg := fmt.Sprintf("Is an agent already running? Path %s exists.", agentPath)
-		notify(msg)
-		le.Printf("%s\n", msg)
-		// Don't remove the socket for the agent running.
-		prevExitFunc(1)
+	if err := devices.Watch(); err != nil {
+		le.Printf("Looking for TKeys on each request: %s\n", err)
+	}
+
+	if preload {
+		devices.Preload()
+	}
+
+	agent := NewSSHAgent(devices, waitForTKey)
+
+	resumed := func() {}
+	if lockOnResume {
+		resumed = agent.LockUntilPresence
+	}
+	if err := devices.WatchSleep(resumed); err != nil {
+		if lockOnResume {
+			le.Printf("--lock-on-resume: %s\n", err)
+			exit(1)
+		}
+		le.Printf("Not following suspend and resume: %s\n", err)
+	}
+
+	if brokerPath != "" {
+		broker := NewBroker(agent)
+		go func() {
+			if err := broker.Serve(brokerPath); err != nil {
+				le.Printf("%s\n", err)
+				exit(1)
+			}
+		}()
 	}
 
-	agent := NewSSHAgent(signer)
 	if err := agent.Serve(agentPath); err != nil {
 		le.Printf("%s\n", err)
 		exit(1)
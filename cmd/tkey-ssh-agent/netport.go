@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TKey can also be reached over TCP, e.g. through ser2net on the
+// machine it's plugged into, by passing tcp://host:port as the port.
+const (
+	tcpPortPrefix     = "tcp://"
+	tcpConnectTimeout = 5 * time.Second
+	tcpDialAttempts   = 3
+	tcpRedialPause    = time.Second
+)
+
+// isNetworkPort tells if path is a network address and not a serial
+// port.
+func isNetworkPort(path string) bool {
+	return strings.HasPrefix(path, tcpPortPrefix)
+}
+
+// parseNetworkPort returns the host:port of a tcp://host:port path.
+func parseNetworkPort(path string) (string, error) {
+	addr := strings.TrimPrefix(path, tcpPortPrefix)
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	return addr, nil
+}
+
+// dialTKey connects to the TKey at a tcp://host:port path, trying a
+// few times since the other end may be restarting.
+func dialTKey(path string) (net.Conn, error) {
+	addr, err := parseNetworkPort(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, tcpConnectTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		if i == tcpDialAttempts {
+			return nil, fmt.Errorf("%w", err)
+		}
+
+		le.Printf("Connecting to %s failed, trying again: %s\n", addr, err)
+		time.Sleep(tcpRedialPause)
+	}
+}
+
+// netBridge makes a TKey on the network look like a local serial
+// port, which is what tkeyclient works with, by copying between the
+// network connection and a pseudo terminal.
+type netBridge struct {
+	path      string // of the serial port for tkeyclient
+	conn      net.Conn
+	term      io.Closer // the pseudo terminal
+	closeOnce sync.Once
+}
+
+// copy moves bytes both ways until either side is closed, and then
+// closes the bridge, so that tkeyclient fails instead of waiting for
+// a TKey that's gone.
+func (b *netBridge) copy(term io.ReadWriter) {
+	go func() {
+		_, _ = io.Copy(b.conn, term)
+		b.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(term, b.conn)
+		le.Printf("Connection to TKey at %s closed\n", b.conn.RemoteAddr())
+		b.Close()
+	}()
+}
+
+func (b *netBridge) Close() error {
+	b.closeOnce.Do(func() {
+		b.conn.Close()
+		b.term.Close()
+	})
+
+	return nil
+}
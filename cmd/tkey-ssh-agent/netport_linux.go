@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openNetBridge connects to the TKey at a tcp://host:port path and
+// returns a bridge to it with a pseudo terminal as serial port.
+func openNetBridge(path string) (*netBridge, error) {
+	conn, err := dialTKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	term, err := openPty()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	b := &netBridge{
+		path: term.slavePath,
+		conn: conn,
+		term: term,
+	}
+	b.copy(term.master)
+
+	return b, nil
+}
+
+type pty struct {
+	master    *os.File
+	slave     int
+	slavePath string
+}
+
+// openPty opens a pseudo terminal in raw mode. We keep the slave open
+// ourselves, so that its settings stay while tkeyclient opens and
+// closes it.
+func openPty() (*pty, error) {
+	// Non-blocking, so that os.NewFile makes it pollable and closing
+	// it interrupts the copying
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/ptmx: %w", err)
+	}
+
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unlock pty: %w", err)
+	}
+
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("get pty number: %w", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := unix.Open(slavePath, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("open %s: %w", slavePath, err)
+	}
+
+	// Like cfmakeraw(3), so nothing is echoed or translated
+	termios, err := unix.IoctlGetTermios(slave, unix.TCGETS)
+	if err == nil {
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		err = unix.IoctlSetTermios(slave, unix.TCSETS, termios)
+	}
+	if err != nil {
+		unix.Close(slave)
+		unix.Close(fd)
+		return nil, fmt.Errorf("set raw mode: %w", err)
+	}
+
+	return &pty{
+		master:    os.NewFile(uintptr(fd), "/dev/ptmx"),
+		slave:     slave,
+		slavePath: slavePath,
+	}, nil
+}
+
+func (p *pty) Close() error {
+	unix.Close(p.slave)
+	return p.master.Close()
+}
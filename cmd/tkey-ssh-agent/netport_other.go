@@ -0,0 +1,12 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openNetBridge(_ string) (*netBridge, error) {
+	return nil, errors.New("TKeys on the network are only supported on Linux")
+}
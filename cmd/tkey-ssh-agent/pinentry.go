@@ -18,12 +18,17 @@ import (
 	"github.com/twpayne/go-pinentry-minimal/pinentry"
 )
 
-func getSecret(udi string, pinentryProgram string) ([]byte, error) {
+func getSecret(name string, udi string, pinentryProgram string) ([]byte, error) {
 	// Displaying the Unique Device Identifier (UDI) so the user will
 	// know which stick they have plugged in.
 	desc := fmt.Sprintf("%s needs a User Supplied Secret\n"+
 		"(USS) for your TKey with number:\n"+
 		"%v", progname, udi)
+	if name != "" {
+		desc = fmt.Sprintf("%s needs a User Supplied Secret\n"+
+			"(USS) for your TKey '%s' with number:\n"+
+			"%v", progname, name, udi)
+	}
 
 	if runtime.GOOS == "darwin" && pinentryProgram == "" {
 		pin, err := macOSPrompt(desc, progname)
@@ -33,6 +38,54 @@ func getSecret(udi string, pinentryProgram string) ([]byte, error) {
 		return []byte(pin), nil
 	}
 
+	opts := pinentryOptions(desc, pinentryProgram,
+		// pinentry-gnome3 uses Prompt as a title so we don't use the
+		// USS abbreviation, and skip trailing ":".
+		pinentry.WithPrompt("User Supplied Secret"))
+
+	client, err := pinentry.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pinentry.NewClient: %w", err)
+	}
+
+	defer client.Close()
+
+	pin, _, err := client.GetPIN()
+	if pinentry.IsCancelled(err) {
+		return nil, ErrUSSCancelled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pinentry GetPin: %w", err)
+	}
+	return []byte(pin), nil
+}
+
+// confirmPresence asks the user, with pinentry, to confirm being at
+// the computer. It returns false if they didn't.
+func confirmPresence(pinentryProgram string) (bool, error) {
+	desc := fmt.Sprintf("%s was locked when the computer went to sleep.\n"+
+		"Allow using your TKey again?", progname)
+
+	client, err := pinentry.NewClient(pinentryOptions(desc, pinentryProgram)...)
+	if err != nil {
+		return false, fmt.Errorf("pinentry.NewClient: %w", err)
+	}
+
+	defer client.Close()
+
+	ok, err := client.Confirm("")
+	if pinentry.IsCancelled(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("pinentry Confirm: %w", err)
+	}
+	return ok, nil
+}
+
+// pinentryOptions returns the options for showing desc with the
+// pinentry program, followed by extra.
+func pinentryOptions(desc string, pinentryProgram string, extra ...pinentry.ClientOption) []pinentry.ClientOption {
 	// The default pinentry program (binaryName) in the client is
 	// "pinentry".
 	opts := []pinentry.ClientOption{
@@ -40,13 +93,11 @@ func getSecret(udi string, pinentryProgram string) ([]byte, error) {
 		pinentry.WithBinaryNameFromGnuPGAgentConf(),
 		pinentry.WithGPGTTY(),
 		pinentry.WithDesc(desc),
-		// pinentry-gnome3 uses Prompt as a title so we don't use the
-		// USS abbreviation, and skip trailing ":".
-		pinentry.WithPrompt("User Supplied Secret"),
 		// Title is not displayed by all pinentry programs (or
 		// displayed obscurely in window title).
 		pinentry.WithTitle(progname),
 	}
+	opts = append(opts, extra...)
 
 	// If argument is passed, add option to override the pinentry program
 	if pinentryProgram != "" {
@@ -59,18 +110,7 @@ func getSecret(udi string, pinentryProgram string) ([]byte, error) {
 		}
 	}
 
-	client, err := pinentry.NewClient(opts...)
-	if err != nil {
-		return nil, fmt.Errorf("pinentry.NewClient: %w", err)
-	}
-
-	defer client.Close()
-
-	pin, _, err := client.GetPIN()
-	if err != nil {
-		return nil, fmt.Errorf("pinentry GetPin: %w", err)
-	}
-	return []byte(pin), nil
+	return opts
 }
 
 func findWindowsPinentry() string {
@@ -151,9 +191,15 @@ func macOSPrompt(msg, title string) (string, error) {
 
 	out, err := c.Output()
 	if err != nil {
+		cancelled := false
 		scanner := bufio.NewScanner(stderror)
 		for scanner.Scan() {
 			le.Printf("osascript stderr: %s\n", scanner.Text())
+			// The error number of the Cancel button
+			cancelled = cancelled || strings.Contains(scanner.Text(), "(-128)")
+		}
+		if cancelled {
+			return "", ErrUSSCancelled
 		}
 		return "", fmt.Errorf("failed to execute osascript: %w", err)
 	}
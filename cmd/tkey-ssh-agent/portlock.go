@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long to wait for another program to let go of the TKey, when
+// using it or just asking what it is, and how often to check. While
+// holding the lock without using the TKey, we check every
+// portLockCheck if another program wants it.
+const (
+	portLockWait  = 30 * time.Second
+	probeLockWait = 2 * time.Second
+	portLockRetry = 200 * time.Millisecond
+	portLockCheck = time.Second
+)
+
+// portLock is an advisory lock on a serial port, shared with other
+// programs talking to the TKey. It is an exclusive flock(2) on Unix,
+// and LockFileEx on Windows, of the file named by portLockPath. A
+// well-behaved program takes it before opening the port and lets go
+// after closing it. While waiting for it, a program sets the
+// modification time of the file to now, asking the holder to let go
+// if it can.
+type portLock struct {
+	f     *os.File
+	since time.Time // modification time when we took it
+}
+
+// portLockDir returns the directory of the lock files. It is private
+// to the user, and fixed so that other TKey programs can find it:
+// $XDG_RUNTIME_DIR/tkey if set, otherwise tkey in the user's cache
+// directory.
+func portLockDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "tkey"), nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no place for lock files: %w", err)
+	}
+
+	return filepath.Join(dir, "tkey"), nil
+}
+
+// portLockPath returns the lock file for the serial port at devPath,
+// e.g. /run/user/1000/tkey/dev-ttyACM0.lock.
+func portLockPath(devPath string) (string, error) {
+	dir, err := portLockDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		}
+		return '-'
+	}, devPath)
+
+	return filepath.Join(dir, strings.Trim(name, "-")+".lock"), nil
+}
+
+// lockPort takes the lock for the serial port at devPath, waiting up
+// to timeout for another program to let go of it. It gives up early
+// if stop is closed.
+func lockPort(devPath string, timeout time.Duration, stop <-chan struct{}) (*portLock, error) {
+	path, err := portLockPath(devPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	// Read-only is enough for locking
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	retry := time.NewTicker(portLockRetry)
+	defer retry.Stop()
+
+	told := false
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if ok {
+			if told {
+				le.Printf("Got the lock for %s\n", devPath)
+			}
+			lock := &portLock{f: f}
+			lock.since = lock.touch()
+			return lock, nil
+		}
+
+		if !told {
+			le.Printf("%s is locked by another program (%s), waiting up to %v\n", devPath, path, timeout)
+			told = true
+		}
+		// Ask the holder to let go
+		_ = os.Chtimes(path, time.Time{}, time.Now())
+
+		select {
+		case <-retry.C:
+		case <-deadline.C:
+			f.Close()
+			return nil, ErrPortBusy
+		case <-stop:
+			f.Close()
+			return nil, errSignerClosed
+		}
+	}
+}
+
+// touch sets the modification time of the lock file to now, and
+// returns what it became.
+func (l *portLock) touch() time.Time {
+	_ = os.Chtimes(l.f.Name(), time.Time{}, time.Now())
+
+	fi, err := os.Stat(l.f.Name())
+	if err != nil {
+		return time.Now()
+	}
+
+	return fi.ModTime()
+}
+
+// wanted tells if another program has asked for the lock since we took
+// it.
+func (l *portLock) wanted() bool {
+	fi, err := os.Stat(l.f.Name())
+	if err != nil {
+		return false
+	}
+
+	return fi.ModTime().After(l.since)
+}
+
+func (l *portLock) unlock() {
+	if err := unlockFile(l.f); err != nil {
+		le.Printf("Unlock %s: %s\n", l.f.Name(), err)
+	}
+	l.f.Close()
+}
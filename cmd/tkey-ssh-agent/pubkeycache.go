@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CachedPubkey is a public key we have seen on a TKey, and what it
+// depends on: the TKey itself, the USS and the signer app. The USB
+// serial number is kept to find the device configuration the same way
+// as for a plugged in TKey.
+type CachedPubkey struct {
+	UDI        string `json:"udi"`
+	Serial     string `json:"serial,omitempty"`
+	ProductID  uint8  `json:"product_id"`
+	USSProfile string `json:"uss_profile"`
+	AppDigest  string `json:"app_digest"`
+	Pubkey     []byte `json:"pubkey"`
+}
+
+// PubkeyCache keeps public keys on disk, so we can list them while
+// the TKey is not plugged in or has not been loaded yet.
+type PubkeyCache struct {
+	path string
+	mu   sync.Mutex
+}
+
+// defaultPubkeyCachePath returns where we keep the public key cache,
+// or "" if there is no such place.
+func defaultPubkeyCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, progname, "pubkeys.json")
+}
+
+func NewPubkeyCache(path string) *PubkeyCache {
+	return &PubkeyCache{path: path}
+}
+
+// Entries returns all cached public keys.
+func (c *PubkeyCache) Entries() []CachedPubkey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.read()
+	if err != nil {
+		le.Printf("Failed to read pubkey cache: %s\n", err)
+	}
+
+	return entries
+}
+
+// Find returns the entry with the public key pub, or nil if it isn't
+// cached.
+func (c *PubkeyCache) Find(pub ed25519.PublicKey) *CachedPubkey {
+	for _, entry := range c.Entries() {
+		if pub.Equal(ed25519.PublicKey(entry.Pubkey)) {
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+var errCachedKeyDiffers = errors.New("another public key is cached")
+
+// Store adds the key for the combination of UDI, USS profile and app
+// in entry. A different key already cached for it is kept, as the new
+// one is most likely from a mistyped USS, and errCachedKeyDiffers is
+// returned.
+func (c *PubkeyCache) Store(entry CachedPubkey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.read()
+	if err != nil {
+		le.Printf("Failed to read pubkey cache, starting over: %s\n", err)
+	}
+
+	for i, e := range entries {
+		if e.UDI == entry.UDI && e.USSProfile == entry.USSProfile && e.AppDigest == entry.AppDigest {
+			if bytes.Equal(e.Pubkey, entry.Pubkey) {
+				if e.Serial != entry.Serial {
+					// Cached before we kept the serial number
+					entries[i].Serial = entry.Serial
+					if err := c.write(entries); err != nil {
+						le.Printf("Failed to write pubkey cache: %s\n", err)
+					}
+				}
+				return nil
+			}
+			le.Printf("TKey %s has another public key than the one in %s, not replacing it\n", entry.UDI, c.path)
+			return errCachedKeyDiffers
+		}
+	}
+	entries = append(entries, entry)
+
+	if err := c.write(entries); err != nil {
+		le.Printf("Failed to write pubkey cache: %s\n", err)
+		return nil
+	}
+	le.Printf("Cached public key of TKey %s\n", entry.UDI)
+
+	return nil
+}
+
+func (c *PubkeyCache) read() ([]CachedPubkey, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	var entries []CachedPubkey
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+
+	return entries, nil
+}
+
+func (c *PubkeyCache) write(entries []CachedPubkey) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return writeFileAtomic(c.path, data)
+}
+
+// writeFileAtomic writes data to path, creating its directory if
+// needed.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	// Write to a temporary file first, so a crash can't leave a
+	// truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return nil
+}
+
+// profile describes where the USS comes from, without revealing
+// anything about the USS itself. A different profile likely means a
+// different key pair.
+func (u UssConfig) profile() string {
+	var parts []string
+
+	switch {
+	case u.EnterManually:
+		parts = append(parts, ussPrompt)
+	case u.Path != "":
+		path := u.Path
+		if abs, err := filepath.Abs(path); err == nil && path != "-" {
+			path = abs
+		}
+		parts = append(parts, ussFile+":"+path)
+	default:
+		parts = append(parts, ussNone)
+	}
+
+	if u.ForceFullUSS {
+		parts = append(parts, "full")
+	}
+
+	return strings.Join(parts, ",")
+}
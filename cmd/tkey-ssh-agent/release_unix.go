@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build unix
+
+package main
+
+import "syscall"
+
+// handleReleaseSignal calls release on SIGUSR1, to let the user hand
+// the TKey over to another program.
+func handleReleaseSignal(release func()) {
+	handleSignals(release, syscall.SIGUSR1)
+}
@@ -0,0 +1,10 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build windows
+
+package main
+
+// handleReleaseSignal does nothing, there's no signal to use for it
+// on Windows.
+func handleReleaseSignal(_ func()) {}
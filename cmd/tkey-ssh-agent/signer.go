@@ -4,15 +4,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/signal"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/tillitis/tkeyclient"
@@ -26,82 +28,462 @@ var notify = func(msg string) {
 }
 
 const (
-	idleDisconnect = 3 * time.Second
+	defaultIdleDisconnect = 3 * time.Second
+	defaultDeviceTimeout  = 5 * time.Second
+	// Loading an app takes a while at the default speed
+	loadAppTimeout = time.Minute
 	// 4 chars each.
 	wantFWName0  = "tk1 "
 	wantFWName1  = "mkdf"
 	wantAppName0 = "tk1 "
 	wantAppName1 = "sign"
+	// Number of extra attempts at talking to the signer app after a
+	// signature was abandoned, to get past any stale response.
+	resyncAttempts = 3
 )
 
+var (
+	errTouchTimeout = errors.New("timed out waiting for touch")
+	errClientGone   = errors.New("client disconnected")
+	errSignerClosed = errors.New("TKey is gone")
+	errWrongKey     = errors.New("not the public key enrolled for this TKey")
+	errNotFirmware  = errors.New("not in firmware mode")
+)
+
+// deviceState is what we know about the TKey of a Signer.
+type deviceState int
+
+const (
+	// Not connected. The TKey may still be plugged in.
+	stateAbsent deviceState = iota
+	// Connected and in firmware mode, but the app isn't loaded.
+	stateFirmware
+	// Connected and running the signer app.
+	stateAppLoaded
+	// Running the signer app, and busy with an operation.
+	stateBusy
+	// Not connected, as it was running some other app when we
+	// looked. It has to be plugged in again to get to firmware mode.
+	stateOtherApp
+)
+
+func (d deviceState) String() string {
+	switch d {
+	case stateAbsent:
+		return "absent"
+	case stateFirmware:
+		return "firmware mode"
+	case stateAppLoaded:
+		return "app loaded"
+	case stateBusy:
+		return "busy"
+	case stateOtherApp:
+		return "running another app"
+	}
+
+	return "unknown"
+}
+
+// Signer manages the session with one TKey. All communication with
+// the TKey is done by a goroutine of its own, see run, which takes
+// requests over a channel.
 type Signer struct {
-	tk              *tkeyclient.TillitisKey
-	tkSigner        *tkeysign.Signer
-	port            Port
-	uss             UssConfig
-	mu              sync.Mutex
-	connected       bool
-	disconnectTimer *time.Timer
+	port     Port
+	opts     *SignerOptions
+	requests chan request
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	info     atomic.Pointer[deviceInfo]
+
+	// Only used by the run goroutine
+	tk           *tkeyclient.TillitisKey
+	tkSigner     *tkeysign.Signer
+	lock         *portLock  // held while the port is open
+	bridge       *netBridge // for a TKey on the network
+	state        deviceState
+	udi          *tkeyclient.UDI
+	loaded       *loadedApp
+	pubkey       ed25519.PublicKey // cached for the session
+	wrongKey     []byte            // last key refused, not the pinned one
+	resync       bool
+	timedOut     bool                    // an exchange timed out while handling a request
+	err          error                   // why the last request failed, if it did
+	app          *tkeyclient.NameVersion // what the signer app said it is
+	noTouch      bool                    // app not known to require touch
+	touchAssumed bool                    // app found running, only assumed to require touch
+}
+
+// deviceInfo is a snapshot of what the run goroutine knows about the
+// TKey, for others to read.
+type deviceInfo struct {
+	state        deviceState
+	udi          *tkeyclient.UDI
+	loaded       *loadedApp
+	err          error
+	app          *tkeyclient.NameVersion
+	noTouch      bool
+	touchAssumed bool
+}
+
+type requestKind int
+
+const (
+	reqPubkey requestKind = iota
+	reqSign
+	reqRelease
+	reqProbe
+)
+
+type request struct {
+	kind    requestKind
+	ctx     context.Context
+	message []byte
+	reply   chan response
+}
+
+type response struct {
+	pubkey    ed25519.PublicKey
+	signature []byte
+	probe     *deviceProbe
+	err       error
+}
+
+// deviceProbe is what a TKey told about itself when asked by Probe.
+type deviceProbe struct {
+	firmware *tkeyclient.NameVersion // nil if not in firmware mode
+	app      *tkeyclient.NameVersion // the signer app, if it answered
+	pubkey   ed25519.PublicKey       // of the signer app, if running
+	udi      *tkeyclient.UDI         // nil if not known
+}
+
+// SignerOptions are the settings shared by the Signers of all TKeys.
+type SignerOptions struct {
+	USS            UssConfig
+	TouchTimeout   time.Duration
+	IdleDisconnect time.Duration
+	// How long to wait for the TKey to answer, except for a touch
+	DeviceTimeout time.Duration
+	// Keep the connection open for as long as the TKey is there,
+	// instead of disconnecting when idle.
+	StayConnected bool
+	Conf          *Config
+	Cache         *PubkeyCache // nil if not caching public keys
+	// Signer app to load onto every TKey, from the command line.
+	// Overrides the configuration file and the embedded apps.
+	AppFile *AppFile
+	// Use signer apps not known to require touch
+	AllowNoTouch bool
 }
 
-func NewSigner(port Port, uss UssConfig, exitFunc func(int)) *Signer {
-	var signer Signer
+// app returns the signer app binary to load onto TKeys with product
+// ID pid. Apps from files are only returned if they have the digest
+// they should have.
+func (o *SignerOptions) app(pid uint8) ([]byte, error) {
+	if o.AppFile != nil {
+		return o.AppFile.Read()
+	}
+
+	if ac := o.Conf.App(pid); ac != nil {
+		return ac.app()
+	}
+
+	return GetApp(pid)
+}
+
+// appDigest returns the digest of the signer app we would load onto
+// TKeys with product ID pid.
+func (o *SignerOptions) appDigest(pid uint8) (string, error) {
+	if o.AppFile != nil {
+		return strings.ToLower(o.AppFile.Digest), nil
+	}
+
+	if ac := o.Conf.App(pid); ac != nil {
+		return ac.digest()
+	}
+
+	app, err := GetApp(pid)
+	if err != nil {
+		return "", err
+	}
 
-	tkeyclient.SilenceLogging()
+	return AppDigest(app), nil
+}
 
+// loadedApp tells how we loaded the signer app that's running on the
+// TKey, in case we did.
+type loadedApp struct {
+	ussProfile string
+	digest     string
+	pubkey     ed25519.PublicKey // once read, if it's the right one
+	// The key differs from the cached one, so it isn't used
+	refused bool
+}
+
+// NewSigner returns a Signer for the TKey on port.Path, and starts
+// its goroutine. Call Close to stop it.
+func NewSigner(port Port, opts *SignerOptions) *Signer {
 	tk := tkeyclient.New()
 
 	tkSigner := tkeysign.New(tk)
-	signer = Signer{
+
+	s := &Signer{
+		port:     port,
+		opts:     opts,
+		requests: make(chan request),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 		tk:       tk,
 		tkSigner: &tkSigner,
-		port:     port,
-		uss:      uss,
 	}
+	s.publish()
 
-	// Do nothing on HUP, in case old udev rule is still in effect
-	handleSignals(func() {}, syscall.SIGHUP)
+	go s.run()
 
-	// Start handling signals here to catch abort during USS entering
-	handleSignals(func() {
-		signer.closeNow()
-		exitFunc(1)
-	}, os.Interrupt, syscall.SIGTERM)
+	return s
+}
 
-	return &signer
+// Close makes the Signer drop its session with the TKey, aborting
+// any operation in progress, and stop. It doesn't wait for that to
+// happen, see Wait.
+func (s *Signer) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
 }
 
-func (s *Signer) connect() bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Wait waits up to timeout for the Signer to stop after Close.
+func (s *Signer) Wait(timeout time.Duration) {
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
 
-	if s.disconnectTimer != nil {
-		s.disconnectTimer.Stop()
-		s.disconnectTimer = nil
+// do hands req to the run goroutine and waits for the response.
+func (s *Signer) do(req request) response {
+	if req.ctx == nil {
+		req.ctx = context.Background()
 	}
+	req.reply = make(chan response, 1)
 
-	if s.connected {
-		return true
+	select {
+	case s.requests <- req:
+	case <-req.ctx.Done():
+		return response{err: context.Cause(req.ctx)}
+	case <-s.done:
+		return response{err: errSignerClosed}
 	}
 
-	devPath := s.port.Path
-	if devPath == "" {
-		var err error
-		devPath, err = tkeyclient.DetectSerialPort(false)
-		if err != nil {
-			switch {
-			case errors.Is(err, tkeyclient.ErrNoDevice):
-				notify("Could not find any TKey plugged in.")
-			case errors.Is(err, tkeyclient.ErrManyDevices):
-				notify("Cannot work with more than 1 TKey plugged in.")
-			default:
-				notify(fmt.Sprintf("TKey detection failed: %s\n", err))
+	// Always answered once taken
+	return <-req.reply
+}
+
+// run owns the connection to the TKey. It serves one request at a
+// time, and disconnects after being idle for a while so that other
+// programs can use the TKey, unless we should stay connected.
+func (s *Signer) run() {
+	defer close(s.done)
+
+	idle := time.NewTimer(s.opts.IdleDisconnect)
+	idle.Stop()
+	check := time.NewTicker(portLockCheck)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			idle.Stop()
+			s.closeNow()
+			return
+
+		case req := <-s.requests:
+			idle.Stop()
+			req.reply <- s.handle(req)
+			if s.lock != nil && !s.opts.StayConnected {
+				idle.Reset(s.opts.IdleDisconnect)
+			}
+
+		case <-idle.C:
+			s.closeNow()
+			le.Printf("Disconnected from TKey\n")
+
+		case <-check.C:
+			// Only while idle, a request is never cut short
+			if s.lock != nil && s.lock.wanted() {
+				idle.Stop()
+				s.closeNow()
+				le.Printf("Released TKey on %s, another program wants it\n", s.port.Path)
 			}
-			le.Printf("Failed to detect port: %v\n", err)
-			return false
 		}
-		le.Printf("Auto-detected serial port %s\n", devPath)
 	}
+}
+
+func (s *Signer) handle(req request) response {
+	if req.kind == reqRelease {
+		if s.lock != nil {
+			s.closeNow()
+			le.Printf("Released TKey on %s\n", s.port.Path)
+		}
+		return response{}
+	}
+
+	if req.kind == reqProbe {
+		probe, err := s.probe()
+		s.publish()
+		return response{probe: probe, err: err}
+	}
+
+	res := s.handleOnce(req)
+	s.err = res.err
+	s.publish()
+
+	// Waiting for a touch has no deadline, so a timeout means nothing
+	// was signed. Try again on a new connection, after finding out
+	// what the TKey is doing now.
+	if s.timedOut {
+		le.Printf("Trying once more after TKey timeout\n")
+		res = s.handleOnce(req)
+		s.err = res.err
+		s.publish()
+	}
+
+	if s.timedOut {
+		notify(fmt.Sprintf("%s stopped responding. Remove and plug it in again if this keeps happening.", s.comment()))
+	}
+
+	return res
+}
+
+func (s *Signer) handleOnce(req request) response {
+	s.timedOut = false
+
+	if err := s.connect(); err != nil {
+		return response{err: err}
+	}
+
+	switch req.kind {
+	case reqPubkey:
+		pub, err := s.getPubkey()
+		return response{pubkey: pub, err: err}
+
+	case reqSign:
+		signature, err := s.sign(req.ctx, req.message)
+		return response{signature: signature, err: err}
+
+	case reqRelease, reqProbe:
+		// Done without connecting, see handle
+	}
+
+	return response{err: fmt.Errorf("unexpected request %d", req.kind)}
+}
+
+// exchange runs f, which talks to the TKey, giving up after timeout.
+// The connection is then closed to make f return, and the next
+// connect has to get past whatever the TKey was doing.
+func (s *Signer) exchange(what string, timeout time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	le.Printf("%s: no answer from TKey on %s within %v, closing connection\n", what, s.port.Path, timeout)
+	s.closeNow()
+	s.resync = true
+	s.timedOut = true
+	<-done
+
+	return ErrDeviceTimeout
+}
+
+// setState changes the state and lets others know.
+func (s *Signer) setState(state deviceState) {
+	s.state = state
+	s.publish()
+}
+
+func (s *Signer) publish() {
+	s.info.Store(&deviceInfo{
+		state:        s.state,
+		udi:          s.udi,
+		loaded:       s.loaded,
+		err:          s.err,
+		app:          s.app,
+		noTouch:      s.noTouch,
+		touchAssumed: s.touchAssumed,
+	})
+}
+
+// State returns the current state of the TKey.
+func (s *Signer) State() deviceState {
+	return s.info.Load().state
+}
+
+// NoTouch tells if the signer app on the TKey is not known to
+// require touch, and was let through by --allow-no-touch.
+func (s *Signer) NoTouch() bool {
+	return s.opts.AllowNoTouch && s.info.Load().noTouch
+}
+
+// TouchAssumed tells if the signer app on the TKey was found running,
+// and is only assumed to require touch, see assumedTouchApps.
+func (s *Signer) TouchAssumed() bool {
+	return s.info.Load().touchAssumed
+}
+
+// SignerStatus is what the agent tells about one of its TKeys, see
+// statusExtension.
+type SignerStatus struct {
+	Port         string  `json:"port"`
+	SerialNumber string  `json:"serial_number,omitempty"`
+	State        string  `json:"state"`
+	AppName      string  `json:"app_name,omitempty"`
+	AppVersion   *uint32 `json:"app_version,omitempty"`
+	// The agent loaded the app, instead of finding it running
+	Loaded  bool `json:"loaded"`
+	NoTouch bool `json:"no_touch,omitempty"`
+	// Found running, only assumed to require touch
+	TouchUnverified bool `json:"touch_unverified,omitempty"`
+	// Why the last operation on the TKey failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns what we know about the TKey now.
+func (s *Signer) Status() SignerStatus {
+	info := s.info.Load()
+
+	status := SignerStatus{
+		Port:            s.port.Path,
+		SerialNumber:    s.port.Serial,
+		State:           info.state.String(),
+		Loaded:          info.loaded != nil,
+		NoTouch:         s.opts.AllowNoTouch && info.noTouch,
+		TouchUnverified: info.touchAssumed,
+	}
+	if info.app != nil {
+		status.AppName = appName(info.app)
+		status.AppVersion = &info.app.Version
+	}
+	if info.err != nil {
+		status.Error = info.err.Error()
+	}
+
+	return status
+}
+
+// open locks the port, waiting at most lockWait for other programs
+// to let go of it, and connects to the TKey on it.
+func (s *Signer) open(lockWait time.Duration) error {
+	devPath := s.port.Path
 
 	options := []func(*tkeyclient.TillitisKey){}
 
@@ -109,48 +491,211 @@ func (s *Signer) connect() bool {
 		options = append(options, tkeyclient.WithSpeed(s.port.Speed))
 	}
 
-	if s.uss.ForceFullUSS {
+	if s.opts.USS.ForceFullUSS {
 		options = append(options, tkeyclient.WithFullUss())
 	}
 
-	le.Printf("Connecting to TKey on serial port %s\n", devPath)
-	if err := s.tk.Connect(devPath, options...); err != nil {
-		notify(fmt.Sprintf("Could not connect to a TKey on port %v.", devPath))
+	// Other programs taking the same lock leave the TKey alone while
+	// we're talking to it, and the other way around
+	lock, err := lockPort(devPath, lockWait, s.stop)
+	if err != nil {
+		le.Printf("Failed to lock port: %v\n", err)
+		return fmt.Errorf("lock %s: %w", devPath, err)
+	}
+
+	serialPath := devPath
+	if isNetworkPort(devPath) {
+		le.Printf("Connecting to TKey at %s\n", devPath)
+		bridge, err := openNetBridge(devPath)
+		if err != nil {
+			lock.unlock()
+			le.Printf("Failed to connect: %v\n", err)
+			return fmt.Errorf("connect to %s: %w", devPath, err)
+		}
+		s.bridge = bridge
+		serialPath = bridge.path
+	}
+
+	le.Printf("Connecting to TKey on serial port %s\n", serialPath)
+	if err := s.tk.Connect(serialPath, options...); err != nil {
+		s.closeBridge()
+		lock.unlock()
 		le.Printf("Failed to connect: %v", err)
-		return false
+		return fmt.Errorf("connect to %s: %w", devPath, err)
+	}
+	s.lock = lock
+
+	return nil
+}
+
+// probe is Probe, in the run goroutine.
+func (s *Signer) probe() (*deviceProbe, error) {
+	if s.lock != nil {
+		// Already talking to the signer app
+		return &deviceProbe{app: s.app, pubkey: s.pubkey, udi: s.udi}, nil
 	}
 
-	if s.isFirmwareMode() {
+	s.timedOut = false
+	if err := s.open(probeLockWait); err != nil {
+		return nil, err
+	}
+	defer s.closeNow()
+
+	fw, err := s.firmwareVersion()
+	if err != nil && !errors.Is(err, errNotFirmware) {
+		return nil, fmt.Errorf("GetNameVersion: %w", err)
+	}
+
+	if fw == nil {
+		s.app = nil
+		wanted := s.isWantedApp()
+		if !wanted && s.timedOut {
+			return nil, fmt.Errorf("GetAppNameVersion: %w", ErrDeviceTimeout)
+		}
+		if !wanted {
+			if s.state == stateOtherApp {
+				// Still stuck, as far as connect is concerned
+				s.closeNow()
+				s.setState(stateOtherApp)
+			}
+			return &deviceProbe{app: s.app}, nil
+		}
+
+		// Asking for the key needs no touch
+		pub, err := s.readPubkey()
+		if err != nil {
+			return nil, err
+		}
+
+		// The UDI is only known if we loaded the app
+		return &deviceProbe{app: s.app, pubkey: pub, udi: s.udi}, nil
+	}
+
+	udi, err := s.getUDI()
+	if err != nil {
+		return nil, fmt.Errorf("GetUDI: %w", err)
+	}
+	s.udi = udi
+
+	return &deviceProbe{firmware: fw, udi: udi}, nil
+}
+
+// getUDI asks the TKey, which must be in firmware mode, for its UDI.
+func (s *Signer) getUDI() (*tkeyclient.UDI, error) {
+	var udi *tkeyclient.UDI
+	err := s.exchange("GetUDI", s.opts.DeviceTimeout, func() error {
+		var err error
+		udi, err = s.tk.GetUDI()
+		return err
+	})
+
+	return udi, err
+}
+
+// connect opens the port, if not already open, and makes sure the
+// TKey is running the signer app, loading it if in firmware mode.
+func (s *Signer) connect() error {
+	if s.lock != nil {
+		return nil
+	}
+
+	if err := s.open(portLockWait); err != nil {
+		if errors.Is(err, ErrPortBusy) {
+			notify(fmt.Sprintf("%s is busy with another program.", s.yourTKey()))
+		} else if !errors.Is(err, errSignerClosed) {
+			notify(fmt.Sprintf("Could not connect to %s on %v.", s.yourTKey(), s.port.Path))
+		}
+		return err
+	}
+	devPath := s.port.Path
+
+	firmware, err := s.isFirmwareMode()
+	if err != nil {
+		le.Printf("Failed to get firmware name and version: %v\n", err)
+		s.closeNow()
+		return fmt.Errorf("GetNameVersion: %w", err)
+	}
+
+	if firmware {
 		le.Printf("TKey is in firmware mode.\n")
 
-		udi, err := s.tk.GetUDI()
+		udi, err := s.getUDI()
 		if err != nil {
 			le.Printf("Failed to get UDI: %v\n", err)
 			s.closeNow()
-			return false
+			return fmt.Errorf("GetUDI: %w", err)
 		}
+		s.udi = udi
+		s.loaded = nil
+		s.wrongKey = nil
+		s.setState(stateFirmware)
 
-		app, err := GetApp(udi.ProductID)
+		app, err := s.opts.app(udi.ProductID)
 		if err != nil {
-			notify("Unknown product ID. Failed to identify what device app to use.")
+			le.Printf("Failed to get app: %v\n", err)
 			s.closeNow()
 
-			return false
+			switch {
+			case errors.Is(err, ErrNotFound):
+				notify(fmt.Sprintf("Unknown product ID %d. Failed to identify what device app to use.", udi.ProductID))
+				return fmt.Errorf("%w: product ID %d", ErrUnknownProduct, udi.ProductID)
+			case errors.Is(err, ErrWrongDigest):
+				notify("Refusing to load the signer app, it doesn't have the expected SHA512 digest.")
+			default:
+				notify(fmt.Sprintf("Could not read the signer app: %s", err))
+			}
+
+			return fmt.Errorf("%w: %w", ErrAppLoad, err)
 		}
 
 		if err := s.loadApp(app, *udi); err != nil {
 			le.Printf("Failed to load app: %v\n", err)
 			s.closeNow()
-			return false
+			return err
 		}
 	}
 
-	if !s.isWantedApp() {
-		// Notifying because we're kinda stuck if we end up here
-		notify("Please remove and plug in your TKey again\n— it might be running the wrong app.")
-		le.Printf("No TKey on the serial port, or it's running wrong app (and is not in firmware mode)")
+	wanted := s.isWantedApp()
+	// A signature we abandoned may still produce a response if the
+	// TKey is touched, so give the app a few more chances.
+	for i := 0; !wanted && s.resync && i < resyncAttempts; i++ {
+		wanted = s.isWantedApp()
+	}
+	s.resync = false
+
+	if !wanted && s.timedOut {
+		// Already closed, and nothing known about the app
+		return fmt.Errorf("GetAppNameVersion: %w", ErrDeviceTimeout)
+	}
+
+	if !wanted {
+		// We're stuck until the TKey is back in firmware mode, which
+		// we look for on the next request. Only tell the user once.
+		if s.state != stateOtherApp {
+			notify(fmt.Sprintf("Please remove and plug in %s again\n— it might be running the wrong app.", s.yourTKey()))
+			le.Printf("No TKey on the serial port, or it's running wrong app (and is not in firmware mode)\n")
+		}
 		s.closeNow()
-		return false
+		s.setState(stateOtherApp)
+		return ErrWrongApp
+	}
+
+	if !firmware {
+		// What we loaded in an earlier session may have been
+		// replaced since, e.g. if the TKey was plugged in again
+		// between requests and another program loaded an app.
+		ours, err := s.stillOurApp()
+		if err != nil {
+			return err
+		}
+		if !ours {
+			s.loaded = nil
+			s.publish()
+		}
+	}
+
+	if err := s.checkTouch(); err != nil {
+		return err
 	}
 
 	// We nowadays disconnect from the TKey when idling, so the
@@ -159,163 +704,532 @@ func (s *Signer) connect() bool {
 	// the flags that tkey-ssh-agent was started with. So we no longer
 	// say anything about that.
 
-	s.connected = true
-	return true
+	s.setState(stateAppLoaded)
+
+	if s.opts.StayConnected {
+		le.Printf("Staying connected to TKey on %s. Other programs can't use it until released, see --stay-connected.\n", devPath)
+	}
+
+	return nil
+}
+
+// stillOurApp tells if the app found running is the one we loaded in
+// an earlier session. The key is derived from the app digest, the USS
+// and the TKey itself, so the app is ours if it has the same key as
+// then.
+func (s *Signer) stillOurApp() (bool, error) {
+	if s.loaded == nil || s.loaded.pubkey == nil {
+		return false, nil
+	}
+
+	pub, err := s.readPubkey()
+	if errors.Is(err, ErrDeviceTimeout) {
+		return false, err
+	}
+	// pub is nil if any other app failed to answer
+	if !bytes.Equal(pub, s.loaded.pubkey) {
+		le.Printf("Signer app on %s is not the one we loaded\n", s.port.Path)
+		return false, nil
+	}
+	if !s.loaded.refused {
+		s.pubkey = s.loaded.pubkey
+	}
+
+	return true, nil
+}
+
+// isFirmwareMode tells if the TKey is in firmware mode. Only a
+// timeout is an error, any other app fails to answer at all.
+func (s *Signer) isFirmwareMode() (bool, error) {
+	_, err := s.firmwareVersion()
+	if errors.Is(err, errNotFirmware) {
+		return false, nil
+	}
+
+	return err == nil, err
 }
 
-func (s *Signer) isFirmwareMode() bool {
-	nameVer, err := s.tk.GetNameVersion()
+// firmwareVersion returns what the firmware says it is. If the TKey
+// isn't in firmware mode the error is errNotFirmware, otherwise as
+// for isFirmwareMode.
+func (s *Signer) firmwareVersion() (*tkeyclient.NameVersion, error) {
+	var nameVer *tkeyclient.NameVersion
+	err := s.exchange("GetNameVersion", s.opts.DeviceTimeout, func() error {
+		var err error
+		nameVer, err = s.tk.GetNameVersion()
+		return err
+	})
+	if errors.Is(err, ErrDeviceTimeout) {
+		return nil, err
+	}
 	if err != nil {
-		return false
+		return nil, fmt.Errorf("%w: %w", errNotFirmware, err)
 	}
 	// not caring about nameVer.Version
-	return nameVer.Name0 == wantFWName0 &&
-		nameVer.Name1 == wantFWName1
+	if nameVer.Name0 != wantFWName0 || nameVer.Name1 != wantFWName1 {
+		return nil, errNotFirmware
+	}
+
+	return nameVer, nil
 }
 
 func (s *Signer) isWantedApp() bool {
-	nameVer, err := s.tkSigner.GetAppNameVersion()
+	if s.lock == nil {
+		// Lost the connection
+		return false
+	}
+
+	var nameVer *tkeyclient.NameVersion
+	err := s.exchange("GetAppNameVersion", s.opts.DeviceTimeout, func() error {
+		var err error
+		nameVer, err = s.tkSigner.GetAppNameVersion()
+		return err
+	})
 	if err != nil {
 		if !errors.Is(err, io.EOF) {
 			le.Printf("GetAppNameVersion: %s\n", err)
 		}
 		return false
 	}
-	// not caring about nameVer.Version
+	s.app = nameVer
+	// The version is up to checkTouch
 	return nameVer.Name0 == wantAppName0 &&
 		nameVer.Name1 == wantAppName1
 }
 
+// checkTouch refuses a signer app that isn't known to require touch,
+// unless allowed by --allow-no-touch. Either way, the user is told
+// once.
+func (s *Signer) checkTouch() error {
+	switch s.opts.touchRequirement(s.loaded, s.app) {
+	case touchKnown:
+		s.noTouch = false
+		s.touchAssumed = false
+		return nil
+
+	case touchAssumed:
+		// Its keys are marked, see SSHAgent.List
+		if !s.touchAssumed {
+			le.Printf("Signer app on %s was already running, assuming it requires touch as its name and version say\n", s.port.Path)
+		}
+		s.noTouch = false
+		s.touchAssumed = true
+		return nil
+
+	case touchUnknown:
+	}
+
+	told := s.noTouch
+	s.noTouch = true
+	s.touchAssumed = false
+
+	if s.opts.AllowNoTouch {
+		if !told {
+			notify(fmt.Sprintf("WARNING: %s will sign without being touched.", s.yourTKey()))
+		}
+		le.Printf("WARNING! Signer app on %s is not known to require touch, allowed by --allow-no-touch\n", s.port.Path)
+		return nil
+	}
+
+	le.Printf("Signer app on %s (version %d) is not known to require touch, refusing it\n", s.port.Path, s.app.Version)
+	s.closeNow()
+
+	if s.loaded != nil {
+		if !told {
+			notify(fmt.Sprintf("Refusing to use %s: the signer app loaded onto it is not known to require touch. List its digest in touch_apps in the configuration file, or pass --allow-no-touch.", s.yourTKey()))
+		}
+		return ErrNoTouch
+	}
+
+	// Plugging it in again gets our own signer app loaded
+	if !told {
+		notify(fmt.Sprintf("Refusing to use %s: its signer app is not known to require touch. Remove and plug it in again, or pass --allow-no-touch.", s.yourTKey()))
+	}
+	s.setState(stateOtherApp)
+
+	return ErrNoTouch
+}
+
 func (s *Signer) loadApp(devApp []byte, udi tkeyclient.UDI) error {
 	var secret []byte
 	var err error
 
-	if s.uss.EnterManually {
-		secret, err = getSecret(udi.String(), s.uss.PinentryPath)
+	uss := s.ussConfig()
+
+	if uss.EnterManually {
+		secret, err = getSecret(s.name(), udi.String(), uss.PinentryPath)
+		if errors.Is(err, ErrUSSCancelled) {
+			return err
+		}
 		if err != nil {
 			notify(fmt.Sprintf("Could not show USS prompt: %s", errors.Unwrap(err)))
-			return fmt.Errorf("failed to get USS: %w", err)
+			return fmt.Errorf("%w: failed to get USS: %w", ErrAppLoad, err)
 		}
-	} else if s.uss.Path != "" {
+	} else if uss.Path != "" {
 		var err error
-		secret, err = tkeyutil.ReadUSS(s.uss.Path)
+		secret, err = tkeyutil.ReadUSS(uss.Path)
 		if err != nil {
 			notify(fmt.Sprintf("Could not read USS file: %s", err))
-			return fmt.Errorf("failed to read uss-file %s: %w", s.uss.Path, err)
+			return fmt.Errorf("%w: failed to read uss-file %s: %w", ErrAppLoad, uss.Path, err)
 		}
 	}
 
 	le.Printf("Loading signer app...\nSHA512: %s\n", AppDigest(devApp))
-	if err := s.tk.LoadApp(devApp, secret); err != nil {
-		return fmt.Errorf("LoadApp: %w", err)
+	err = s.exchange("LoadApp", loadAppTimeout, func() error {
+		return s.tk.LoadApp(devApp, secret)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: LoadApp: %w", ErrAppLoad, err)
 	}
 	le.Printf("Signer app loaded.\n")
 
+	s.loaded = &loadedApp{
+		ussProfile: uss.profile(),
+		digest:     AppDigest(devApp),
+	}
+	s.publish()
+
 	return nil
 }
 
-func (s *Signer) printAuthorizedKey() {
-	if !s.connect() {
-		le.Printf("Connect failed")
-		return
+// ussConfig returns the USS configuration for the TKey, which may
+// have its own in the configuration file.
+func (s *Signer) ussConfig() UssConfig {
+	if dev := s.opts.Conf.Device(s.port.Serial, s.udiString()); dev != nil {
+		return dev.ussConfig(s.opts.USS)
 	}
-	defer s.disconnect()
 
-	pub, err := s.tkSigner.GetPubkey()
+	return s.opts.USS
+}
+
+// udiString returns the UDI of the TKey, or "" if it isn't known.
+func (s *Signer) udiString() string {
+	udi := s.info.Load().udi
+	if udi == nil {
+		return ""
+	}
+
+	return udi.String()
+}
+
+// name returns the friendly name of the TKey from the configuration,
+// or "" if it has none.
+func (s *Signer) name() string {
+	if dev := s.opts.Conf.Device(s.port.Serial, s.udiString()); dev != nil {
+		return dev.Name
+	}
+
+	return ""
+}
+
+// yourTKey returns how to refer to the TKey in messages to the user.
+func (s *Signer) yourTKey() string {
+	if name := s.name(); name != "" {
+		return fmt.Sprintf("your TKey '%s'", name)
+	}
+
+	return "your TKey"
+}
+
+// comment returns a description of the TKey suitable as comment for
+// its public key. The UDI is only known if we found the TKey in
+// firmware mode.
+func (s *Signer) comment() string {
+	if name := s.name(); name != "" {
+		return fmt.Sprintf("TKey '%s'", name)
+	}
+
+	if udi := s.udiString(); udi != "" {
+		return fmt.Sprintf("TKey %s", udi)
+	}
+
+	return fmt.Sprintf("TKey on %s", s.port.Path)
+}
+
+func (s *Signer) printAuthorizedKey() error {
+	pub, err := s.PublicKey()
 	if err != nil {
-		le.Printf("GetPubkey failed: %s\n", err)
-		return
+		le.Printf("Getting public key from %s failed: %s\n", s.port.Path, err)
+		return err
 	}
 
-	sshPub, err := ssh.NewPublicKey(ed25519.PublicKey(pub))
+	sshPub, err := ssh.NewPublicKey(pub)
 	if err != nil {
 		le.Printf("NewPublicKey failed: %s\n", err)
-		return
+		return fmt.Errorf("NewPublicKey: %w", err)
 	}
 
-	le.Printf("Your SSH public key (on stdout):\n")
-	fmt.Fprintf(os.Stdout, "%s", ssh.MarshalAuthorizedKey(sshPub))
+	le.Printf("SSH public key of %s (on stdout):\n", s.comment())
+	fmt.Fprintf(os.Stdout, "%s %s\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshPub)), s.comment())
+
+	return nil
 }
 
-func (s *Signer) disconnect() {
-	if s.tkSigner == nil {
+// closeNow closes the connection to the TKey, ending the session.
+func (s *Signer) closeNow() {
+	if s.lock == nil {
+		// Not connected
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.tkSigner.Close(); err != nil {
+		le.Printf("Close failed: %s\n", err)
+	}
+	s.closeBridge()
+	s.lock.unlock()
+	s.lock = nil
 
-	if !s.connected {
-		return
+	s.pubkey = nil
+	s.setState(stateAbsent)
+}
+
+// closeBridge closes the connection to a TKey on the network, if any.
+func (s *Signer) closeBridge() {
+	if s.bridge != nil {
+		s.bridge.Close()
+		s.bridge = nil
+	}
+}
+
+// getPubkey returns the public key, only asking the TKey once per
+// session.
+func (s *Signer) getPubkey() (ed25519.PublicKey, error) {
+	if s.pubkey != nil {
+		return s.pubkey, nil
+	}
+	if s.loaded != nil && s.loaded.refused {
+		return nil, errWrongKey
 	}
 
-	if s.disconnectTimer != nil {
-		s.disconnectTimer.Stop()
-		s.disconnectTimer = nil
+	pub, err := s.readPubkey()
+	if err != nil {
+		return nil, err
 	}
 
-	s.disconnectTimer = time.AfterFunc(idleDisconnect, func() {
-		s.mu.Lock()
-		defer s.mu.Unlock()
+	if ok, known := s.keyAllowed(pub); !ok {
+		// Only tell once for each wrong key, List is called often
+		if !bytes.Equal(pub, s.wrongKey) {
+			s.wrongKey = pub
+			if known {
+				s.notifyWrongKey()
+			} else {
+				s.notifyUnknownUDI()
+			}
+		}
+		return nil, errWrongKey
+	}
 
-		s.closeNow()
-		s.connected = false
-		s.disconnectTimer = nil
-		le.Printf("Disconnected from TKey\n")
+	// We can only tell what the key belongs to if we loaded the app,
+	// and only cache it the first time it's read after loading
+	if s.loaded != nil && s.loaded.pubkey == nil {
+		s.loaded.pubkey = pub
+		if !s.cachePubkey() {
+			s.loaded.refused = true
+			return nil, errWrongKey
+		}
+	}
+	s.pubkey = ed25519.PublicKey(pub)
+
+	return s.pubkey, nil
+}
+
+// readPubkey asks the signer app for its public key, which needs no
+// touch.
+func (s *Signer) readPubkey() (ed25519.PublicKey, error) {
+	var pub []byte
+	err := s.exchange("GetPubkey", s.opts.DeviceTimeout, func() error {
+		var err error
+		pub, err = s.tkSigner.GetPubkey()
+		return err
 	})
+	if err != nil {
+		return nil, fmt.Errorf("GetPubkey: %w", err)
+	}
+
+	return pub, nil
 }
 
-func (s *Signer) closeNow() {
-	if s.tkSigner == nil {
+// keyAllowed tells if pub is the key pinned for the TKey, or there is
+// none. Pins by UDI can't be told apart if the signer app was already
+// running, so the UDI is then looked up by the key in the pubkey cache
+// and the pins. Failing that, the key is refused if any pin by UDI
+// could be for this TKey, and known is false.
+func (s *Signer) keyAllowed(pub ed25519.PublicKey) (ok bool, known bool) {
+	udi := s.udiString()
+	if udi == "" && s.opts.Cache != nil {
+		if entry := s.opts.Cache.Find(pub); entry != nil {
+			udi = entry.UDI
+		}
+	}
+	if udi != "" {
+		return s.opts.Conf.Device(s.port.Serial, udi).keyMatches(pub), true
+	}
+
+	pins := s.opts.Conf.pinnedByUDI(s.port.Serial)
+	for _, dev := range pins {
+		if dev.keyMatches(pub) {
+			return true, true
+		}
+	}
+	if len(pins) > 0 {
+		return false, false
+	}
+
+	return s.opts.Conf.Device(s.port.Serial, "").keyMatches(pub), true
+}
+
+// cachePubkey stores the public key of the app we just loaded in the
+// pubkey cache, if any. It returns false if another key is cached for
+// the same TKey and settings, and the key should not be used.
+func (s *Signer) cachePubkey() bool {
+	if s.opts.Cache == nil {
+		return true
+	}
+
+	err := s.opts.Cache.Store(CachedPubkey{
+		UDI:        s.udi.String(),
+		Serial:     s.port.Serial,
+		ProductID:  s.udi.ProductID,
+		USSProfile: s.loaded.ussProfile,
+		AppDigest:  s.loaded.digest,
+		Pubkey:     s.loaded.pubkey,
+	})
+	if errors.Is(err, errCachedKeyDiffers) {
+		notify(fmt.Sprintf("The public key of %s differs from the cached one, the USS might be mistyped, so it will not be used. Remove and plug it in again to re-enter the USS. If the new key is right, remove the old one from %s and plug it in again.", s.yourTKey(), s.opts.Cache.path))
+		return false
+	}
+
+	return true
+}
+
+// notifyWrongKey tells the user that the TKey doesn't have the
+// public key it should, most likely because of a mistyped USS.
+func (s *Signer) notifyWrongKey() {
+	le.Printf("Public key of TKey on %s does not match the enrolled one\n", s.port.Path)
+
+	if s.loaded != nil && s.ussConfig().EnterManually {
+		notify(fmt.Sprintf("USS does not match the enrolled identity of %s. Remove and plug it in again to re-enter the USS.", s.yourTKey()))
 		return
 	}
-	if err := s.tkSigner.Close(); err != nil {
-		le.Printf("Close failed: %s\n", err)
+
+	notify(fmt.Sprintf("USS does not match the enrolled identity of %s. Its key will not be used.", s.yourTKey()))
+}
+
+// notifyUnknownUDI tells the user that a key can't be checked against
+// the pins, as the UDI isn't known.
+func (s *Signer) notifyUnknownUDI() {
+	le.Printf("UDI of TKey on %s is not known, can't check its public key against the pinned ones\n", s.port.Path)
+	notify(fmt.Sprintf("Can't tell if %s has its enrolled public key, as it was already running the signer app. Remove and plug it in again to use it.", s.yourTKey()))
+}
+
+// sign signs message on the TKey. If ctx is done, the touch timeout
+// passes, or we're closed before the signature is ready, the session
+// with the TKey is aborted so that a late touch won't complete it.
+func (s *Signer) sign(ctx context.Context, message []byte) ([]byte, error) {
+	s.setState(stateBusy)
+	defer func() {
+		if s.state == stateBusy {
+			s.setState(stateAppLoaded)
+		}
+	}()
+
+	type result struct {
+		signature []byte
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		signature, err := s.tkSigner.Sign(message)
+		done <- result{signature, err}
+	}()
+
+	var timeout <-chan time.Time
+	if s.opts.TouchTimeout > 0 {
+		timer := time.NewTimer(s.opts.TouchTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var cause error
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, fmt.Errorf("Sign: %w", res.err)
+		}
+		return res.signature, nil
+	case <-ctx.Done():
+		cause = context.Cause(ctx)
+	case <-timeout:
+		cause = errTouchTimeout
+	case <-s.stop:
+		cause = errSignerClosed
 	}
+
+	// Closing the port makes the pending read fail. The next connect
+	// will have to get past whatever the device app was doing.
+	s.closeNow()
+	s.resync = true
+	<-done
+	le.Printf("Aborted TKey session\n")
+
+	return nil, fmt.Errorf("Sign: %w", cause)
 }
 
-// implementing crypto.Signer below
+// Release closes the connection to the TKey, if any, so that other
+// programs can use it. It is opened again when needed.
+func (s *Signer) Release() {
+	_ = s.do(request{kind: reqRelease})
+}
 
-func (s *Signer) Public() crypto.PublicKey {
-	if !s.connect() {
-		return nil
+// Probe finds out what the TKey is doing, without loading any app.
+// It only connects for as long as it takes to ask, and gives up if
+// another program holds the TKey.
+func (s *Signer) Probe() (*deviceProbe, error) {
+	res := s.do(request{kind: reqProbe})
+	return res.probe, res.err
+}
+
+// PublicKey returns the public key of the TKey, connecting to it and
+// loading the signer app if needed.
+func (s *Signer) PublicKey() (ed25519.PublicKey, error) {
+	res := s.do(request{kind: reqPubkey})
+	if res.err != nil {
+		return nil, res.err
 	}
-	defer s.disconnect()
 
-	pub, err := s.tkSigner.GetPubkey()
+	return res.pubkey, nil
+}
+
+// implementing crypto.Signer below
+
+// Public is PublicKey, but returns nil on failure, see Err for why.
+func (s *Signer) Public() crypto.PublicKey {
+	pub, err := s.PublicKey()
 	if err != nil {
-		le.Printf("GetPubkey failed: %s\n", err)
+		le.Printf("Getting public key failed: %s\n", err)
 		return nil
 	}
-	return ed25519.PublicKey(pub)
+
+	return pub
 }
 
 func (s *Signer) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
-	if !s.connect() {
-		return nil, fmt.Errorf("connect failed")
-	}
-	defer s.disconnect()
+	return s.signContext(context.Background(), message, opts)
+}
 
+// signContext is Sign, but gives up if ctx is done before the
+// signature is ready.
+func (s *Signer) signContext(ctx context.Context, message []byte, opts crypto.SignerOpts) ([]byte, error) {
 	// The Ed25519 signature must be made over unhashed message. See:
 	// https://cs.opensource.google/go/go/+/refs/tags/go1.18.4:src/crypto/ed25519/ed25519.go;l=80
 	if opts.HashFunc() != crypto.Hash(0) {
 		return nil, errors.New("message must not be hashed")
 	}
 
-	signature, err := s.tkSigner.Sign(message)
-	if err != nil {
-		return nil, fmt.Errorf("Sign: %w", err)
+	res := s.do(request{kind: reqSign, ctx: ctx, message: message})
+	if res.err != nil {
+		return nil, res.err
 	}
-	return signature, nil
-}
 
-func handleSignals(action func(), sig ...os.Signal) {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, sig...)
-	go func() {
-		for {
-			<-ch
-			action()
-		}
-	}()
+	return res.signature, nil
 }
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	logindDest  = "org.freedesktop.login1"
+	logindPath  = "/org/freedesktop/login1"
+	logindIface = "org.freedesktop.login1.Manager"
+)
+
+// watchSleep calls handle, from a goroutine of its own, when logind
+// says that the system is about to sleep (true), and when it has
+// resumed (false).
+func watchSleep(handle func(sleeping bool)) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("system bus: %w", err)
+	}
+
+	if err := followSleep(conn, handle); err != nil {
+		conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// followSleep is watchSleep on conn, the system bus or, in tests, a
+// private one.
+func followSleep(conn *dbus.Conn, handle func(sleeping bool)) error {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(logindPath),
+		dbus.WithMatchInterface(logindIface),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		return fmt.Errorf("AddMatchSignal: %w", err)
+	}
+
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	inhibit := delaySleep(conn)
+
+	go func() {
+		for sig := range signals {
+			if sig.Name != logindIface+".PrepareForSleep" || len(sig.Body) != 1 {
+				continue
+			}
+			sleeping, ok := sig.Body[0].(bool)
+			if !ok {
+				continue
+			}
+
+			handle(sleeping)
+
+			if sleeping && inhibit != nil {
+				// Done, the system may sleep now
+				inhibit.Close()
+				inhibit = nil
+			} else if !sleeping && inhibit == nil {
+				inhibit = delaySleep(conn)
+			}
+		}
+		le.Printf("Stopped following suspend and resume\n")
+	}()
+
+	return nil
+}
+
+// delaySleep takes a delay inhibitor lock, so that the system waits
+// for us to let go of the TKeys before sleeping, and returns it. It
+// returns nil if that's not possible, the system then sleeps without
+// waiting for us.
+func delaySleep(conn *dbus.Conn) *os.File {
+	var fd dbus.UnixFD
+	err := conn.Object(logindDest, logindPath).Call(logindIface+".Inhibit", 0,
+		"sleep", progname, "Closing the connection to the TKey", "delay").Store(&fd)
+	if err != nil {
+		le.Printf("Could not delay sleep: %s\n", err)
+		return nil
+	}
+
+	return os.NewFile(uintptr(fd), "logind inhibitor")
+}
@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+// privateBus starts a dbus-daemon of its own and returns its address.
+func privateBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	addr := "unix:path=" + filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--nopidfile", "--print-address", "--address="+addr)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// It prints the address once it listens
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon: %s", err)
+	}
+
+	return strings.TrimSpace(line)
+}
+
+func connectBus(t *testing.T, addr string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// fakeLogind hands out inhibitor locks like logind: the write end of
+// a pipe, whose read end tells when the lock is let go.
+type fakeLogind struct {
+	events chan<- string
+}
+
+func (f *fakeLogind) Inhibit(what string, _ string, _ string, mode string) (dbus.UnixFD, *dbus.Error) {
+	if what != "sleep" || mode != "delay" {
+		return 0, dbus.MakeFailedError(os.ErrInvalid)
+	}
+
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC); err != nil {
+		return 0, dbus.MakeFailedError(err)
+	}
+	r, w := fds[0], fds[1]
+
+	go func() {
+		// The reply is sent after we return, so let go of our copy
+		// of the write end once the agent has its own
+		waitPipeFds(r, 3)
+		unix.Close(w)
+		f.events <- "inhibit"
+
+		// Returns when every copy of the write end is closed
+		_, _ = unix.Read(r, make([]byte, 1))
+		unix.Close(r)
+		f.events <- "released"
+	}()
+
+	return dbus.UnixFD(w), nil
+}
+
+// waitPipeFds waits for n file descriptors of this process to refer to
+// the pipe of fd.
+func waitPipeFds(fd int, n int) {
+	pipe, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return
+	}
+
+	for {
+		entries, _ := os.ReadDir("/proc/self/fd")
+		found := 0
+		for _, e := range entries {
+			if link, err := os.Readlink("/proc/self/fd/" + e.Name()); err == nil && link == pipe {
+				found++
+			}
+		}
+		if found >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectEvent(t *testing.T, events <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %q", want)
+	}
+}
+
+func TestFollowSleep(t *testing.T) {
+	addr := privateBus(t)
+	events := make(chan string, 10)
+
+	logind := &fakeLogind{events: events}
+	logindConn := connectBus(t, addr)
+	if err := logindConn.Export(logind, logindPath, logindIface); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := logindConn.RequestName(logindDest, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("RequestName: %v %v", reply, err)
+	}
+
+	conn := connectBus(t, addr)
+	err = followSleep(conn, func(sleeping bool) {
+		if sleeping {
+			events <- "sleep"
+		} else {
+			events <- "resume"
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent delays sleep from the start
+	expectEvent(t, events, "inhibit")
+
+	emit := func(sleeping bool) {
+		t.Helper()
+		if err := logindConn.Emit(logindPath, logindIface+".PrepareForSleep", sleeping); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The TKeys are let go of before the system may sleep
+	emit(true)
+	expectEvent(t, events, "sleep")
+	expectEvent(t, events, "released")
+
+	// And sleep is delayed again after resume
+	emit(false)
+	expectEvent(t, events, "resume")
+	expectEvent(t, events, "inhibit")
+
+	emit(true)
+	expectEvent(t, events, "sleep")
+	expectEvent(t, events, "released")
+}
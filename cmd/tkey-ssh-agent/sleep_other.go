@@ -0,0 +1,12 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchSleep(_ func(sleeping bool)) error {
+	return errors.New("suspend and resume events not supported on this system")
+}
@@ -5,12 +5,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -18,16 +23,19 @@ import (
 )
 
 // May be set to non-empty at build time to indicate that the signer
-// app has been compiled with touch requirement removed.
+// app has been compiled with touch requirement removed. The embedded
+// apps are then not known to require touch, see touchDigests.
 var signerAppNoTouch string
 
 type SSHAgent struct {
-	signer      *Signer
-	operationMu sync.Mutex // only handling 1 agent op at a time
+	devices     *Devices
+	waitForTKey time.Duration // 0 means don't wait
+	operationMu sync.Mutex    // only handling 1 agent op at a time
+	locked      atomic.Bool   // until the user confirms presence
 }
 
-func NewSSHAgent(signer *Signer) *SSHAgent {
-	return &SSHAgent{signer: signer}
+func NewSSHAgent(devices *Devices, waitForTKey time.Duration) *SSHAgent {
+	return &SSHAgent{devices: devices, waitForTKey: waitForTKey}
 }
 
 func (s *SSHAgent) Serve(absSockPath string) error {
@@ -51,48 +59,226 @@ func (s *SSHAgent) Serve(absSockPath string) error {
 }
 
 func (s *SSHAgent) handleConn(c net.Conn) {
-	if err := agent.ServeAgent(s, c); !errors.Is(err, io.EOF) {
+	defer c.Close()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	ca := &connAgent{SSHAgent: s, ctx: ctx}
+	if err := agent.ServeAgent(ca, watchConn(c, cancel)); !errors.Is(err, io.EOF) {
 		le.Printf("Agent client connection ended with error: %s\n", err)
 	}
 }
 
+// watchConn returns a ReadWriter for c where all reading is done by a
+// separate goroutine. This lets us notice that the client has hung
+// up even while we're busy handling one of its requests, in which
+// case cancel is called.
+func watchConn(c net.Conn, cancel context.CancelCauseFunc) io.ReadWriter {
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := io.Copy(pw, c)
+		cancel(errClientGone)
+		// A nil err makes the reader get io.EOF
+		pw.CloseWithError(err)
+	}()
+
+	return struct {
+		io.Reader
+		io.Writer
+	}{pr, c}
+}
+
+// connAgent is the agent as seen by a single client connection. Its
+// context is cancelled when the client goes away.
+type connAgent struct {
+	*SSHAgent
+	ctx context.Context
+}
+
+func (c *connAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.sign(c.ctx, key, data)
+}
+
+func (c *connAgent) SignWithFlags(key ssh.PublicKey, data []byte, _ agent.SignatureFlags) (*ssh.Signature, error) {
+	// we only do ed25519, so no need to care about flags
+	return c.sign(c.ctx, key, data)
+}
+
+// ctxSigner binds a context to the Signer for a single signature.
+type ctxSigner struct {
+	*Signer
+	ctx context.Context
+}
+
+func (c ctxSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return c.Signer.signContext(c.ctx, message, opts)
+}
+
 // implementing agent.ExtendedAgent below
 
 var ErrNotImplemented = errors.New("not implemented")
 
+var errLocked = errors.New("agent locked until presence is confirmed")
+
+// LockUntilPresence makes the agent refuse to list keys or sign until
+// the user confirms being there, which they are asked at the next
+// use.
+func (s *SSHAgent) LockUntilPresence() {
+	if s.locked.Swap(true) {
+		return
+	}
+
+	le.Printf("Agent locked until presence is confirmed\n")
+	notify("Locked. Confirm that it's you at the next use of your TKey.")
+}
+
+// checkPresence asks the user to confirm being there, if the agent is
+// locked, and unlocks it if they do.
+func (s *SSHAgent) checkPresence() error {
+	if !s.locked.Load() {
+		return nil
+	}
+
+	ok, err := confirmPresence(s.devices.opts.USS.PinentryPath)
+	if err != nil {
+		notify(fmt.Sprintf("Could not ask for confirmation: %s", err))
+		return fmt.Errorf("%w: %w", errLocked, err)
+	}
+	if !ok {
+		le.Printf("Presence not confirmed, staying locked\n")
+		return errLocked
+	}
+
+	s.locked.Store(false)
+	le.Printf("Presence confirmed, agent unlocked\n")
+
+	return nil
+}
+
 func (s *SSHAgent) List() ([]*agent.Key, error) {
 	s.operationMu.Lock()
 	defer s.operationMu.Unlock()
 
-	// Connect early to be able to return empty list if that fails
-	if !s.signer.connect() {
-		le.Printf("List: connect failed, returning empty list\n")
-		return []*agent.Key{}, nil
+	if err := s.checkPresence(); err != nil {
+		return nil, err
 	}
 
-	pub := s.signer.Public()
-	if pub == nil {
-		return nil, fmt.Errorf("pubkey is nil")
+	keys := []*agent.Key{}
+
+	signers := s.devices.Signers()
+	if len(signers) == 0 && s.devices.opts.Cache == nil {
+		s.devices.notifyMissing()
 	}
 
-	sshPub, err := ssh.NewPublicKey(pub)
-	if err != nil {
-		return nil, fmt.Errorf("NewPublicKey: %w", err)
+	for _, signer := range signers {
+		pub, err := signer.PublicKey()
+		if err != nil {
+			le.Printf("List: no pubkey from %s, skipping it: %s\n", signer.port.Path, err)
+			continue
+		}
+
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("NewPublicKey: %w", err)
+		}
+
+		comment := signer.comment()
+		if signer.NoTouch() {
+			comment += " (WARNING: signs without touch)"
+		} else if signer.TouchAssumed() {
+			comment += " (WARNING: touch not verified)"
+		}
+
+		keys = append(keys, &agent.Key{
+			Format:  sshPub.Type(),
+			Blob:    sshPub.Marshal(),
+			Comment: comment,
+		})
 	}
 
-	return []*agent.Key{{
-		Format:  sshPub.Type(),
-		Blob:    sshPub.Marshal(),
-		Comment: "TKey",
-	}}, nil
+	// Also list keys of TKeys that are not plugged in, or that we
+	// failed to load
+	cached, comments := s.devices.CachedPubkeys()
+	for i, entry := range cached {
+		sshPub, err := ssh.NewPublicKey(ed25519.PublicKey(entry.Pubkey))
+		if err != nil {
+			le.Printf("List: bad cached pubkey: %s\n", err)
+			continue
+		}
+
+		if hasKey(keys, sshPub) {
+			continue
+		}
+
+		keys = append(keys, &agent.Key{
+			Format:  sshPub.Type(),
+			Blob:    sshPub.Marshal(),
+			Comment: comments[i],
+		})
+	}
+
+	return keys, nil
+}
+
+func hasKey(keys []*agent.Key, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (s *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.sign(context.Background(), key, data)
+}
+
+func (s *SSHAgent) sign(ctx context.Context, key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.signFor(ctx, key, data, "SSH login")
+}
+
+// signFor signs data with the TKey having key, telling the user what
+// it's for in notifications.
+func (s *SSHAgent) signFor(ctx context.Context, key ssh.PublicKey, data []byte, purpose string) (*ssh.Signature, error) {
+	s.operationMu.Lock()
+	if err := s.checkPresence(); err != nil {
+		s.operationMu.Unlock()
+		return nil, err
+	}
+	signer, err := s.devices.Lookup(key)
+	s.operationMu.Unlock()
+
+	wait := s.waitForTKey
+	if wait == 0 && s.devices.OtherAppMightHave(key) {
+		// It might be the TKey we want, just give the user a chance
+		// to plug it in again
+		wait = otherAppWait
+	}
+	if signer == nil && wait > 0 {
+		// Without holding operationMu, so that other TKeys can be
+		// used meanwhile
+		signer = s.devices.WaitFor(ctx, key, wait, purpose)
+		if signer == nil {
+			err = fmt.Errorf("%w with that public key", ErrNoDevice)
+		}
+	}
+	if signer == nil {
+		return nil, err
+	}
+
 	s.operationMu.Lock()
 	defer s.operationMu.Unlock()
 
-	// This does s.signer.Public()
-	sshSigner, err := ssh.NewSignerFromSigner(s.signer)
+	// Getting it here first, to have the reason if it fails
+	if _, err := signer.PublicKey(); err != nil {
+		return nil, fmt.Errorf("PublicKey: %w", err)
+	}
+
+	// This does signer.Public()
+	sshSigner, err := ssh.NewSignerFromSigner(ctxSigner{signer, ctx})
 	if err != nil {
 		return nil, fmt.Errorf("NewSignerFromSigner: %w", err)
 	}
@@ -101,17 +287,23 @@ func (s *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error)
 		return nil, fmt.Errorf("pubkey mismatch")
 	}
 
-	if signerAppNoTouch == "" {
+	if !signer.NoTouch() {
 		timer := time.AfterFunc(4*time.Second, func() {
-			notify("Touch your TKey to confirm SSH login.")
+			notify(fmt.Sprintf("Touch %s to confirm %s.", signer.yourTKey(), purpose))
 		})
 		defer timer.Stop()
 
 		le.Printf("Sign: user will have to touch the TKey\n")
 	} else {
-		le.Printf("Sign: WARNING! This tkey-ssh-agent and signer app is built with the touch requirement removed\n")
+		le.Printf("Sign: WARNING! The signer app is not known to require touch, allowed by --allow-no-touch\n")
 	}
 	signature, err := sshSigner.Sign(rand.Reader, data)
+	switch {
+	case errors.Is(err, errTouchTimeout):
+		notify("Timed out waiting for touch. The signature was cancelled.")
+	case errors.Is(err, errClientGone):
+		notify("The client went away. The pending signature was cancelled.")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Signer.Sign: %w", err)
 	}
@@ -123,11 +315,28 @@ func (s *SSHAgent) SignWithFlags(key ssh.PublicKey, data []byte, _ agent.Signatu
 	return s.Sign(key, data)
 }
 
-func (s *SSHAgent) Extension(_ string, _ []byte) ([]byte, error) {
-	// there is a new extensionType session-bind@openssh.com, but
-	// implementation still seems optional
-	// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent
-	return nil, agent.ErrExtensionUnsupported
+// statusExtension is the agent extension that returns the status of
+// each TKey, as JSON of []SignerStatus after SSH_AGENT_SUCCESS. It's
+// what -L --details shows about a running agent.
+const statusExtension = "tkey-status@tillitis.se"
+
+// SSH_AGENT_SUCCESS, from PROTOCOL.agent
+const agentSuccess = 6
+
+func (s *SSHAgent) Extension(extensionType string, _ []byte) ([]byte, error) {
+	if extensionType != statusExtension {
+		// there is a new extensionType session-bind@openssh.com, but
+		// implementation still seems optional
+		// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	status, err := json.Marshal(s.devices.Status())
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	return append([]byte{agentSuccess}, status...), nil
 }
 
 func (s *SSHAgent) Add(_ agent.AddedKey) error {
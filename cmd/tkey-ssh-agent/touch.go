@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"strings"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// touchApp is a signer app release that waits for a touch before
+// signing, as it answers GetAppNameVersion.
+type touchApp struct {
+	name0   string
+	name1   string
+	version uint32
+}
+
+// The releases of tkey-device-signer that require touch. A build with
+// the touch requirement removed answers the same, so an app found
+// running that answers like one of these is only assumed to require
+// touch, it can't be told. Apps we load ourselves are checked by
+// digest instead.
+var assumedTouchApps = []touchApp{
+	{wantAppName0, wantAppName1, 1},
+}
+
+// touchRequirement is what we know about whether a signer app waits
+// for a touch before signing.
+type touchRequirement int
+
+const (
+	// Not known to require touch
+	touchUnknown touchRequirement = iota
+	// Found running, answering like a release that requires touch
+	touchAssumed
+	// Loaded by us, with a digest known to require touch
+	touchKnown
+)
+
+// touchDigests returns the digests of the signer app builds known to
+// require touch: the embedded ones, unless built without it, and any
+// listed in the configuration file.
+func (o *SignerOptions) touchDigests() map[string]bool {
+	digests := map[string]bool{}
+
+	if signerAppNoTouch == "" {
+		for _, app := range ListApps() {
+			digests[app.digest] = true
+		}
+	}
+
+	for _, digest := range o.Conf.TouchApps {
+		digests[strings.ToLower(digest)] = true
+	}
+
+	return digests
+}
+
+// touchRequirement tells what we know about whether the signer app
+// running on a TKey waits for a touch before signing. loaded is how we
+// loaded it, or nil if it was already running, and nameVer is what it
+// answered GetAppNameVersion.
+func (o *SignerOptions) touchRequirement(loaded *loadedApp, nameVer *tkeyclient.NameVersion) touchRequirement {
+	if loaded != nil {
+		if o.touchDigests()[loaded.digest] {
+			return touchKnown
+		}
+		return touchUnknown
+	}
+
+	for _, app := range assumedTouchApps {
+		if nameVer.Name0 == app.name0 && nameVer.Name1 == app.name1 && nameVer.Version == app.version {
+			return touchAssumed
+		}
+	}
+
+	return touchUnknown
+}
@@ -0,0 +1,436 @@
+// SPDX-FileCopyrightText: 2026 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+	"github.com/tillitis/tkeysign"
+)
+
+// Largest firmware size tried when it isn't given to verify-device.
+const maxFirmwareSize = 8192
+
+const verifyUsage = `Usage: %[1]s verify-device DATA VENDOR_KEYS [FIRMWARE_SIZE]
+
+Check that the TKey is a genuine Tillitis device, offline. It must be
+in firmware mode, so plug it in just before. Use --port or
+--serial-number to choose the TKey if more than one is plugged in.
+
+DATA           The verification data for the TKey, as published for
+               its UDI by Tillitis for tkey-verification.
+VENDOR_KEYS    The Tillitis vendor signing public keys, in hex, one at
+               the start of each line.
+FIRMWARE_SIZE  The size in bytes of the firmware of this TKey model.
+               If not given, every size up to %[3]d bytes is tried
+               until the vendor signature verifies, which takes a
+               while. The size found is printed.
+
+The signer app the data was made with is loaded onto the TKey, without
+USS. It must be an embedded app or the one passed with --app-file.
+Remove and plug in the TKey again afterwards, before using it.
+
+The result is recorded with the UDI in %[2]s, for your
+reference. The agent doesn't read it.
+`
+
+// Verification is the verification data of a TKey, as published by
+// tkey-verification. Signature is the vendor's signature of the UDI,
+// the firmware digest, and the public key the TKey has with the app
+// in AppTag loaded without USS, see verifyMessage.
+type Verification struct {
+	Timestamp json.RawMessage `json:"timestamp"`
+	AppTag    string          `json:"apptag"`
+	AppHash   string          `json:"apphash"`
+	Signature string          `json:"signature"`
+}
+
+// VerifiedDevice is the result of verify-device for a TKey.
+type VerifiedDevice struct {
+	UDI       string `json:"udi"`
+	ProductID uint8  `json:"product_id"`
+	Genuine   bool   `json:"genuine"`
+	AppTag    string `json:"apptag"`
+	Time      string `json:"time"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// defaultVerifiedPath returns where we record the results of
+// verify-device, or "" if there is no such place.
+func defaultVerifiedPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, progname, "verified.json")
+}
+
+// recordVerified adds or replaces the result for the TKey in dev.
+func recordVerified(path string, dev VerifiedDevice) error {
+	devs, err := readVerified(path)
+	if err != nil {
+		le.Printf("Failed to read %s, starting over: %s\n", path, err)
+	}
+
+	found := false
+	for i := range devs {
+		if devs[i].UDI == dev.UDI {
+			devs[i] = dev
+			found = true
+		}
+	}
+	if !found {
+		devs = append(devs, dev)
+	}
+
+	data, err := json.MarshalIndent(devs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// readVerified returns the recorded results of verify-device.
+func readVerified(path string) ([]VerifiedDevice, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	var devs []VerifiedDevice
+	if err := json.Unmarshal(data, &devs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return devs, nil
+}
+
+// readVendorKeys reads the vendor signing public keys in path. Each
+// line starts with a key in hex, anything after it is ignored, as are
+// empty lines and lines starting with '#'.
+func readVendorKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(fields[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: not an Ed25519 public key in hex", path, n)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return keys, nil
+}
+
+// readVerification reads the verification data in path.
+func readVerification(path string) (*Verification, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	var v Verification
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !validDigest(v.AppHash) {
+		return nil, fmt.Errorf("%s: apphash is not a SHA512 digest in hex", path)
+	}
+	if sig, err := hex.DecodeString(v.Signature); err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%s: signature is not an Ed25519 signature in hex", path)
+	}
+
+	return &v, nil
+}
+
+// verifyApp returns the app binary with digest, among the embedded
+// apps and appFile, which may be nil.
+func verifyApp(digest string, appFile *AppFile) ([]byte, error) {
+	digest = strings.ToLower(digest)
+
+	if appFile != nil && strings.ToLower(appFile.Digest) == digest {
+		return appFile.Read()
+	}
+
+	for _, app := range ListApps() {
+		if app.digest == digest {
+			return app.bin, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// verifyMessage returns what the vendor signed for a genuine TKey:
+// its UDI, the digest of its firmware, and its public key with the
+// verification app.
+func verifyMessage(udiBE []byte, fwDigest []byte, pubkey []byte) ([]byte, error) {
+	if len(udiBE) != 8 {
+		return nil, fmt.Errorf("UDI is %d bytes, expected 8", len(udiBE))
+	}
+	if len(fwDigest) != sha512.Size {
+		return nil, fmt.Errorf("firmware digest is %d bytes, expected %d", len(fwDigest), sha512.Size)
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, expected %d", len(pubkey), ed25519.PublicKeySize)
+	}
+
+	msg := make([]byte, 0, len(udiBE)+len(fwDigest)+len(pubkey))
+	msg = append(msg, udiBE...)
+	msg = append(msg, fwDigest...)
+	msg = append(msg, pubkey...)
+
+	return msg, nil
+}
+
+// findPort returns the port of the single TKey to use, or
+// ErrNoDevice or ErrManyDevices.
+func findPort(port Port) (Port, error) {
+	if port.Path != "" {
+		return port, nil
+	}
+
+	ports, err := tkeyclient.GetSerialPorts()
+	if err != nil {
+		return port, fmt.Errorf("GetSerialPorts: %w", err)
+	}
+
+	var found []tkeyclient.SerialPort
+	for _, p := range ports {
+		if port.Serial == "" || p.SerialNumber == port.Serial {
+			found = append(found, p)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return port, ErrNoDevice
+	case 1:
+		port.Path = found[0].DevPath
+		port.Serial = found[0].SerialNumber
+		return port, nil
+	}
+
+	return port, fmt.Errorf("%w, pass --port or --serial-number", ErrManyDevices)
+}
+
+// verifyDeviceCommand runs the verify-device subcommand with args,
+// and returns the exit code.
+func verifyDeviceCommand(args []string, port Port, appFile *AppFile) int {
+	if len(args) != 2 && len(args) != 3 {
+		le.Printf(verifyUsage, progname, defaultVerifiedPath(), maxFirmwareSize)
+		return 2
+	}
+
+	fwSize := 0 // look for it
+	if len(args) == 3 {
+		var err error
+		fwSize, err = strconv.Atoi(args[2])
+		if err != nil || fwSize <= 0 {
+			le.Printf("FIRMWARE_SIZE must be a positive number of bytes.\n\n")
+			le.Printf(verifyUsage, progname, defaultVerifiedPath(), maxFirmwareSize)
+			return 2
+		}
+	}
+
+	v, err := readVerification(args[0])
+	if err != nil {
+		le.Printf("Failed to read verification data: %s\n", err)
+		return 1
+	}
+
+	vendorKeys, err := readVendorKeys(args[1])
+	if err != nil {
+		le.Printf("Failed to read vendor keys: %s\n", err)
+		return 1
+	}
+
+	app, err := verifyApp(v.AppHash, appFile)
+	if err != nil {
+		le.Printf("Verifying needs the signer app %s with SHA512 %s, pass it with --app-file: %s\n", v.AppTag, v.AppHash, err)
+		return 1
+	}
+
+	port, err = findPort(port)
+	if err != nil {
+		le.Printf("%s\n", err)
+		return exitCode(err)
+	}
+
+	dev, err := verifyDevice(port, v, app, fwSize, vendorKeys)
+	if dev == nil {
+		le.Printf("Verification of TKey on %s failed: %s\n", port.Path, err)
+		return exitCode(err)
+	}
+
+	if err != nil {
+		dev.Reason = err.Error()
+		fmt.Printf("TKey %s is NOT verified as genuine: %s\n", dev.UDI, err)
+	} else {
+		fmt.Printf("TKey %s is genuine.\n", dev.UDI)
+	}
+
+	if path := defaultVerifiedPath(); path != "" {
+		if err := recordVerified(path, *dev); err != nil {
+			le.Printf("Failed to record the result: %s\n", err)
+			return 1
+		}
+		le.Printf("Recorded the result in %s\n", path)
+	}
+
+	if !dev.Genuine {
+		return 1
+	}
+
+	return 0
+}
+
+// verifyDevice checks the TKey on port against v. It returns the
+// result once the UDI is known, with an error telling why it failed
+// if it did. If fwSize is 0, the firmware sizes up to maxFirmwareSize
+// are tried.
+func verifyDevice(port Port, v *Verification, app []byte, fwSize int, vendorKeys []ed25519.PublicKey) (*VerifiedDevice, error) {
+	lock, err := lockPort(port.Path, portLockWait, nil)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", port.Path, err)
+	}
+	defer lock.unlock()
+
+	serialPath := port.Path
+	if isNetworkPort(port.Path) {
+		bridge, err := openNetBridge(port.Path)
+		if err != nil {
+			return nil, fmt.Errorf("connect to %s: %w", port.Path, err)
+		}
+		defer bridge.Close()
+		serialPath = bridge.path
+	}
+
+	var options []func(*tkeyclient.TillitisKey)
+	if port.Speed != 0 {
+		options = append(options, tkeyclient.WithSpeed(port.Speed))
+	}
+
+	tk := tkeyclient.New()
+	le.Printf("Connecting to TKey on serial port %s\n", serialPath)
+	if err := tk.Connect(serialPath, options...); err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", port.Path, err)
+	}
+	signer := tkeysign.New(tk)
+	defer signer.Close()
+
+	nameVer, err := tk.GetNameVersion()
+	if err != nil || nameVer.Name0 != wantFWName0 || nameVer.Name1 != wantFWName1 {
+		return nil, fmt.Errorf("%w, remove and plug it in again", ErrWrongApp)
+	}
+
+	udi, err := tk.GetUDI()
+	if err != nil {
+		return nil, fmt.Errorf("GetUDI: %w", err)
+	}
+	udiBE, err := udi.RawBytes()
+	if err != nil {
+		return nil, fmt.Errorf("UDI: %w", err)
+	}
+
+	dev := &VerifiedDevice{
+		UDI:       udi.String(),
+		ProductID: udi.ProductID,
+		AppTag:    v.AppTag,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}
+	le.Printf("TKey UDI: %s\nLoading %s...\n", dev.UDI, v.AppTag)
+
+	if err := tk.LoadApp(app, nil); err != nil {
+		return nil, fmt.Errorf("%w: LoadApp: %w", ErrAppLoad, err)
+	}
+	// Otherwise the agent would find the app running and use the key
+	// without USS
+	defer le.Printf("Remove and plug in the TKey again before using it, it's running %s without USS now.\n", v.AppTag)
+
+	pubkey, err := signer.GetPubkey()
+	if err != nil {
+		return nil, fmt.Errorf("GetPubkey: %w", err)
+	}
+
+	// Make the TKey prove that it has the private key
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	le.Printf("Touch the TKey to sign a challenge.\n")
+	sig, err := signer.Sign(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("Sign: %w", err)
+	}
+	if !ed25519.Verify(pubkey, challenge, sig) {
+		return dev, errors.New("the TKey's signature of the challenge doesn't verify")
+	}
+
+	first, last := fwSize, fwSize
+	if fwSize == 0 {
+		le.Printf("Looking for the firmware size, this takes a while...\n")
+		first, last = 1, maxFirmwareSize
+	}
+
+	vendorSig, _ := hex.DecodeString(v.Signature)
+	for size := first; size <= last; size++ {
+		fwDigest, err := signer.GetFWDigest(size)
+		if err != nil && fwSize == 0 && size > 1 {
+			// Past the end of the firmware ROM
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetFWDigest: %w", err)
+		}
+
+		msg, err := verifyMessage(udiBE, fwDigest, pubkey)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range vendorKeys {
+			if ed25519.Verify(key, msg, vendorSig) {
+				if fwSize == 0 {
+					le.Printf("Firmware size: %d bytes\n", size)
+				}
+				dev.Genuine = true
+				return dev, nil
+			}
+		}
+	}
+
+	return dev, errors.New("the vendor signature doesn't verify, the TKey, its firmware or the data is not what Tillitis signed")
+}